@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	auditRepo = flag.Bool("audit", false,
+		"Instead of running, write a record of each run committed to the clone of a repo given as an argument, "+
+			"read from the trailers crony adds to its commit messages, oldest first, in -audit_format")
+	auditFormat = flag.String("audit_format", "json",
+		"Format of -audit's records: \"json\", one object per line, or \"csv\", with a header row")
+)
+
+// Trailers crony adds to the message of each commit it makes for a run, from which -audit reads the run back.
+const (
+	commandTrailer  = "Crony-Command"
+	scheduleTrailer = "Crony-Schedule"
+	fireTimeTrailer = "Crony-Fire-Time"
+	triggerTrailer  = "Crony-Trigger"
+	startTrailer    = "Crony-Start"
+	exitCodeTrailer = "Crony-Exit-Code"
+	errorTrailer    = "Crony-Error"
+)
+
+// trigger is what caused a run.
+type trigger string
+
+const (
+	// The run's scheduled time came.
+	triggerSchedule trigger = "schedule"
+	// Someone asked for it with POST /run.
+	triggerManual trigger = "manual"
+	// It ran as soon as its crontab was loaded, because it has run_on_start, or is an overdue @since_success job.
+	triggerCatchup trigger = "catchup"
+)
+
+// runTrailers returns the trailers to end the commit message of a run of j with, which was scheduled for fireTime
+// and caused by trigger, started at start, and exited with exitCode, failing with runErr if it failed.
+func runTrailers(j job, fireTime time.Time, trigger trigger, start time.Time, exitCode int, runErr error) string {
+	trailers := fmt.Sprintf("%s: %s\n%s: %s\n%s: %s\n%s: %s\n%s: %s\n%s: %d\n",
+		commandTrailer, redact(j.Command),
+		scheduleTrailer, j.Schedule.Cron(),
+		fireTimeTrailer, fireTime.UTC().Format(time.RFC3339),
+		triggerTrailer, trigger,
+		startTrailer, start.UTC().Format(time.RFC3339),
+		exitCodeTrailer, exitCode)
+	if runErr != nil {
+		// Only the first line, since a trailer can't span several.
+		trailers += fmt.Sprintf("%s: %s\n", errorTrailer, strings.SplitN(redact(runErr.Error()), "\n", 2)[0])
+	}
+	return trailers
+}
+
+// exitCode returns the code with which a command exited, given the error running it returned,
+// which is 0 if the error is nil, or -1 if the command didn't exit normally, say because it was killed.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// AuditRecord describes a run that crony committed, as read back from its commit.
+type AuditRecord struct {
+	Commit   string `json:"commit"`
+	Command  string `json:"command"`
+	Schedule string `json:"schedule"`
+	// When the run was scheduled for, and what caused it, if the commit records them; older commits don't.
+	FireTime *time.Time `json:"fire_time,omitempty"`
+	Trigger  string     `json:"trigger,omitempty"`
+	Start    time.Time  `json:"start"`
+	ExitCode int        `json:"exit_code"`
+	// Why the run failed, if it did; it may have failed despite exiting with 0, e.g. with require_clean_after.
+	Error string `json:"error,omitempty"`
+}
+
+// Separators between the commits, and the fields of each, in the output of git log below.
+const (
+	recordSeparator = "\x1e"
+	fieldSeparator  = "\x1f"
+)
+
+// readAudit reads the record of each run committed to the clone in dir, oldest first, by way of g.
+// Commits without crony's trailers, such as those people made, are skipped.
+func readAudit(g GitBackend, dir string) ([]AuditRecord, error) {
+	output, err := g.Run(dir, "log", "--reverse",
+		"--format=%H"+fieldSeparator+"%(trailers:only,unfold)"+recordSeparator)
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	for _, commit := range strings.Split(string(output), recordSeparator) {
+		fields := strings.SplitN(strings.TrimSpace(commit), fieldSeparator, 2)
+		if len(fields) != 2 {
+			continue
+		}
+		trailers := make(map[string]string)
+		for _, line := range strings.Split(fields[1], "\n") {
+			if keyValue := strings.SplitN(line, ": ", 2); len(keyValue) == 2 {
+				trailers[keyValue[0]] = keyValue[1]
+			}
+		}
+		command, ok := trailers[commandTrailer]
+		if !ok {
+			continue
+		}
+		record := AuditRecord{
+			Commit:   fields[0],
+			Command:  command,
+			Schedule: trailers[scheduleTrailer],
+			Trigger:  trailers[triggerTrailer],
+			Error:    trailers[errorTrailer],
+		}
+		if fireTime, ok := trailers[fireTimeTrailer]; ok {
+			t, err := time.Parse(time.RFC3339, fireTime)
+			if err != nil {
+				return nil, fmt.Errorf("commit %s has an invalid %s: %s", fields[0], fireTimeTrailer, err)
+			}
+			record.FireTime = &t
+		}
+		if record.Start, err = time.Parse(time.RFC3339, trailers[startTrailer]); err != nil {
+			return nil, fmt.Errorf("commit %s has an invalid %s: %s", fields[0], startTrailer, err)
+		}
+		if record.ExitCode, err = strconv.Atoi(trailers[exitCodeTrailer]); err != nil {
+			return nil, fmt.Errorf("commit %s has an invalid %s: %s", fields[0], exitCodeTrailer, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// writeAudit writes records to out in the given format, "json" or "csv".
+func writeAudit(records []AuditRecord, format string, out io.Writer) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write([]string{"commit", "command", "schedule", "fire_time", "trigger", "start", "exit_code", "error"})
+		for _, record := range records {
+			var fireTime string
+			if record.FireTime != nil {
+				fireTime = record.FireTime.Format(time.RFC3339)
+			}
+			w.Write([]string{record.Commit, record.Command, record.Schedule, fireTime, record.Trigger,
+				record.Start.Format(time.RFC3339), strconv.Itoa(record.ExitCode), record.Error})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("unknown -audit_format %q; expected json or csv", format)
+}
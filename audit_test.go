@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditExport(t *testing.T) {
+	setUpGit(t)
+	dir := filepath.Join(t.TempDir(), "repo")
+	runGit(t, "", "init", "-q", "-b", "master", dir)
+	commit := func(msg string) string {
+		runGit(t, dir, "commit", "-q", "--allow-empty", "-m", msg)
+		return strings.TrimSpace(runGit(t, dir, "rev-parse", "HEAD"))
+	}
+	commit("a commit someone made\n\nCo-authored-by: someone <someone@localhost>")
+	// Before commits recorded when runs were scheduled for, or why.
+	old := commit("crony: sync (exit 0)\n\n$ ./sync\n\n" +
+		"Crony-Command: ./sync\nCrony-Schedule: 0 * * * *\nCrony-Start: 2026-10-14T09:00:01Z\nCrony-Exit-Code: 0\n")
+	failed := commit("crony: report (exit 2)\n\n$ ./report, with a comma\nno data\n\n" +
+		"Crony-Command: ./report, with a comma\nCrony-Schedule: 30 9 * * 1-5\nCrony-Fire-Time: 2026-10-15T09:30:00Z\n" +
+		"Crony-Trigger: schedule\nCrony-Start: 2026-10-15T09:30:02Z\nCrony-Exit-Code: 2\nCrony-Error: exit status 2\n")
+
+	records, err := readAudit(execGit{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fireTime := time.Date(2026, time.October, 15, 9, 30, 0, 0, time.UTC)
+	want := []AuditRecord{
+		{Commit: old, Command: "./sync", Schedule: "0 * * * *",
+			Start: time.Date(2026, time.October, 14, 9, 0, 1, 0, time.UTC), ExitCode: 0},
+		{Commit: failed, Command: "./report, with a comma", Schedule: "30 9 * * 1-5", FireTime: &fireTime, Trigger: "schedule",
+			Start: time.Date(2026, time.October, 15, 9, 30, 2, 0, time.UTC), ExitCode: 2, Error: "exit status 2"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("read records %+v, want %+v", records, want)
+	}
+
+	for _, test := range []struct {
+		format, want string
+	}{
+		{"json", `{"commit":"` + old + `","command":"./sync","schedule":"0 * * * *","start":"2026-10-14T09:00:01Z","exit_code":0}` + "\n" +
+			`{"commit":"` + failed + `","command":"./report, with a comma","schedule":"30 9 * * 1-5","fire_time":"2026-10-15T09:30:00Z",` +
+			`"trigger":"schedule","start":"2026-10-15T09:30:02Z","exit_code":2,"error":"exit status 2"}` + "\n"},
+		{"csv", "commit,command,schedule,fire_time,trigger,start,exit_code,error\n" +
+			old + ",./sync,0 * * * *,,,2026-10-14T09:00:01Z,0,\n" +
+			failed + `,"./report, with a comma",30 9 * * 1-5,2026-10-15T09:30:00Z,schedule,2026-10-15T09:30:02Z,2,exit status 2` + "\n"},
+	} {
+		var out strings.Builder
+		if err := writeAudit(records, test.format, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s export is:\n%s\nwant:\n%s", test.format, out.String(), test.want)
+		}
+	}
+	if err := writeAudit(records, "xml", &strings.Builder{}); err == nil {
+		t.Error("exported in an unknown format")
+	}
+}
+
+func TestRunTrailers(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 2 * * * date +%N > now.txt\n"})
+	start := time.Date(2026, time.October, 15, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	m, _ := newTestManager(t, execGit{}, nil, clock, origin)
+	waitLoaded(t, m, origin)
+	trailers := func() map[string]string {
+		found := make(map[string]string)
+		for _, line := range strings.Split(runGit(t, origin, "log", "-1", "--format=%(trailers:only,unfold)", "master"), "\n") {
+			if nameValue := strings.SplitN(line, ": ", 2); len(nameValue) == 2 {
+				found[nameValue[0]] = nameValue[1]
+			}
+		}
+		return found
+	}
+	initial := runGit(t, origin, "rev-parse", "master")
+
+	fired := time.Date(2026, time.October, 16, 2, 0, 0, 0, time.UTC)
+	clock.set(fired.Add(time.Second))
+	eventually(t, "the scheduled run wasn't pushed", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.inFlight == 0 && runGit(t, origin, "rev-parse", "master") != initial
+	})
+	scheduled := trailers()
+	for name, want := range map[string]string{
+		"Crony-Command":   "date +%N > now.txt",
+		"Crony-Schedule":  "0 2 * * *",
+		"Crony-Fire-Time": "2026-10-16T02:00:00Z",
+		"Crony-Trigger":   "schedule",
+		"Crony-Exit-Code": "0",
+	} {
+		if got := scheduled[name]; got != want {
+			t.Errorf("scheduled run's %s trailer is %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := m.RunNow(origin, "", "date"); err != nil {
+		t.Fatal(err)
+	}
+	manual := trailers()
+	for name, want := range map[string]string{
+		"Crony-Schedule":  "0 2 * * *",
+		"Crony-Fire-Time": clock.Now().UTC().Format(time.RFC3339),
+		"Crony-Trigger":   "manual",
+	} {
+		if got := manual[name]; got != want {
+			t.Errorf("manual run's %s trailer is %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var (
+	gitBinary = flag.String("git_binary", "git",
+		"git executable to run, by path, or by name to look it up in $PATH")
+	gitConfig = flag.String("git_config", "",
+		"If set, run git with this file as its global config, in place of the user's ~/.gitconfig, and without the system config, "+
+			"so that it behaves the same on every host; /dev/null uses git's defaults")
+)
+
+// GitBackend performs git operations on local clones, each identified by the directory of its working tree.
+// The default, execGit, shells out to the git binary.
+type GitBackend interface {
+	// Clone makes a local clone of origin in dir.
+	Clone(origin, dir string) error
+	// Fetch fetches ref from origin into FETCH_HEAD.
+	Fetch(dir, ref string) error
+	// Pull incorporates origin's changes into the current branch, by rebasing any local commits onto origin's,
+	// or if ffOnly is set, by fast-forwarding.
+	// If that's not possible, it returns an error, leaving dir as it was.
+	Pull(dir string, ffOnly bool) error
+	// Commit commits all changes in dir, including untracked files.
+	Commit(dir, msg string) error
+	// Merge fast-forwards the current branch to branch.
+	Merge(dir, branch string) error
+	// Push pushes the current branch to origin.
+	Push(dir string) error
+	// Status describes uncommitted changes in dir, one path per line; it's empty if there are none.
+	Status(dir string) ([]byte, error)
+	// RevParse returns the commit ID that rev refers to.
+	RevParse(dir, rev string) (string, error)
+	// Run runs an arbitrary git command in dir, for operations without a dedicated method,
+	// returning its combined output.
+	Run(dir string, args ...string) ([]byte, error)
+}
+
+// execGit is a GitBackend that runs the git binary.
+type execGit struct {
+	// Settings, as "NAME=value", added to git's environment, e.g. to authenticate to origin.
+	env []string
+}
+
+func (g execGit) Clone(origin, dir string) error {
+	_, err := g.Run("", "clone", origin, dir)
+	return err
+}
+
+func (g execGit) Fetch(dir, ref string) error {
+	_, err := g.Run(dir, "fetch", "origin", ref)
+	return err
+}
+
+func (g execGit) Pull(dir string, ffOnly bool) error {
+	if ffOnly {
+		_, err := g.Run(dir, "pull", "--ff-only")
+		return err
+	}
+	if _, err := g.Run(dir, "pull", "--rebase"); err != nil {
+		g.Run(dir, "rebase", "--abort")
+		return err
+	}
+	return nil
+}
+
+func (g execGit) Commit(dir, msg string) error {
+	if _, err := g.Run(dir, "add", "."); err != nil {
+		return err
+	}
+	_, err := g.Run(dir, "commit", "-a", "-m", msg)
+	return err
+}
+
+func (g execGit) Merge(dir, branch string) error {
+	_, err := g.Run(dir, "merge", "--ff-only", branch)
+	return err
+}
+
+func (g execGit) Push(dir string) error {
+	_, err := g.Run(dir, "push")
+	return err
+}
+
+func (g execGit) Status(dir string) ([]byte, error) {
+	return g.Run(dir, "status", "-s")
+}
+
+func (g execGit) RevParse(dir, rev string) (string, error) {
+	output, err := g.Run(dir, "rev-parse", "--verify", rev)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (g execGit) Run(dir string, args ...string) ([]byte, error) {
+	glog.V(3).Infof("%s$ git %s", dir, strings.Join(args, " "))
+	cmd := exec.Command(*gitBinary, args...)
+	cmd.Dir = dir
+	if env := g.environ(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	output, err := cmd.CombinedOutput()
+	glog.V(4).Info(string(output))
+	if err != nil {
+		return output, fmt.Errorf("%s\n%s", output, err)
+	}
+	return output, nil
+}
+
+// environ returns the settings, as "NAME=value", to add to git's environment: the backend's own, and -git_config's.
+func (g execGit) environ() []string {
+	env := g.env
+	if *gitConfig != "" {
+		env = append(env[:len(env):len(env)], "GIT_CONFIG_GLOBAL="+*gitConfig, "GIT_CONFIG_NOSYSTEM=1")
+	}
+	return env
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a GitBackend that records each operation performed through it, and fails those it's told to,
+// running the rest with the git binary, so that tests can check what crony asked of git against real repos.
+type fakeBackend struct {
+	execGit
+
+	mu sync.Mutex
+	// Operations performed, in order, each named by its method, or for Run, "Run" and the git subcommand,
+	// e.g. "Push" or "Run checkout".
+	calls []string
+	// Errors to fail operations with instead of performing them, in turn, by name as in calls.
+	failures map[string][]error
+}
+
+// failNext makes the next len(errs) calls to the named operation fail with errs, in turn.
+func (f *fakeBackend) failNext(op string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures == nil {
+		f.failures = make(map[string][]error)
+	}
+	f.failures[op] = append(f.failures[op], errs...)
+}
+
+// record notes a call to the named operation, returning the error to fail it with, if any.
+func (f *fakeBackend) record(op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, op)
+	if errs := f.failures[op]; len(errs) > 0 {
+		f.failures[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// called returns the operations performed so far that are among ops, in order.
+func (f *fakeBackend) called(ops ...string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []string
+	for _, call := range f.calls {
+		for _, op := range ops {
+			if call == op {
+				calls = append(calls, call)
+			}
+		}
+	}
+	return calls
+}
+
+func (f *fakeBackend) Clone(origin, dir string) error {
+	if err := f.record("Clone"); err != nil {
+		return err
+	}
+	return f.execGit.Clone(origin, dir)
+}
+
+func (f *fakeBackend) Fetch(dir, ref string) error {
+	if err := f.record("Fetch"); err != nil {
+		return err
+	}
+	return f.execGit.Fetch(dir, ref)
+}
+
+func (f *fakeBackend) Pull(dir string, ffOnly bool) error {
+	if err := f.record("Pull"); err != nil {
+		return err
+	}
+	return f.execGit.Pull(dir, ffOnly)
+}
+
+func (f *fakeBackend) Commit(dir, msg string) error {
+	if err := f.record("Commit"); err != nil {
+		return err
+	}
+	return f.execGit.Commit(dir, msg)
+}
+
+func (f *fakeBackend) Merge(dir, branch string) error {
+	if err := f.record("Merge"); err != nil {
+		return err
+	}
+	return f.execGit.Merge(dir, branch)
+}
+
+func (f *fakeBackend) Push(dir string) error {
+	if err := f.record("Push"); err != nil {
+		return err
+	}
+	return f.execGit.Push(dir)
+}
+
+func (f *fakeBackend) Status(dir string) ([]byte, error) {
+	if err := f.record("Status"); err != nil {
+		return nil, err
+	}
+	return f.execGit.Status(dir)
+}
+
+func (f *fakeBackend) RevParse(dir, rev string) (string, error) {
+	if err := f.record("RevParse"); err != nil {
+		return "", err
+	}
+	return f.execGit.RevParse(dir, rev)
+}
+
+func (f *fakeBackend) Run(dir string, args ...string) ([]byte, error) {
+	op := "Run"
+	if len(args) > 0 {
+		op += " " + args[0]
+	}
+	if err := f.record(op); err != nil {
+		return nil, err
+	}
+	return f.execGit.Run(dir, args...)
+}
+
+func TestExecuteCommandCommitsMergesAndPushes(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	git := &fakeBackend{}
+	r := newTestRepo(t, git, origin)
+
+	executeCommand(&EventBus{}, testJob(t, "* * * * * echo hello > greeting.txt; echo done"), r, time.Now(), triggerSchedule, nil)
+	if got, want := strings.Join(git.called("Commit", "Merge", "Push"), " "), "Commit Merge Push"; got != want {
+		t.Errorf("git operations were %s, want %s", got, want)
+	}
+	if got := originFile(t, origin, "master", "greeting.txt"); got != "hello\n" {
+		t.Errorf("greeting.txt in origin is %q, want %q", got, "hello\n")
+	}
+	msg := runGit(t, origin, "log", "-1", "--format=%B", "master")
+	if !strings.HasPrefix(msg, "crony: echo-hello-greeting-txt-echo-done (exit 0)\n") || !strings.Contains(msg, "\ndone\n") {
+		t.Errorf("commit message is %q, want the run's subject and output", msg)
+	}
+	if len(r.ActiveWorkdirs()) != 0 {
+		t.Errorf("workdirs still active after the run: %v", r.ActiveWorkdirs())
+	}
+}
+
+// recordEvents subscribes to bus, returning a function that returns the types of events published so far, in order.
+func recordEvents(bus *EventBus) func() []EventType {
+	var mu sync.Mutex
+	var types []EventType
+	bus.Subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		types = append(types, e.Type)
+	})
+	return func() []EventType {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]EventType(nil), types...)
+	}
+}
+
+func TestExecuteCommandFailedPush(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	git := &fakeBackend{}
+	r := newTestRepo(t, git, origin)
+	r.rewriteMode = rewritePreserve
+	before := runGit(t, origin, "rev-parse", "master")
+
+	// Pushing is retried once after pulling.
+	git.failNext("Push", fmt.Errorf("remote hung up"), fmt.Errorf("remote hung up"))
+	bus := &EventBus{}
+	events := recordEvents(bus)
+	executeCommand(bus, testJob(t, "* * * * * date > now.txt"), r, time.Now(), triggerSchedule, nil)
+	if got := fmt.Sprint(events()); !strings.Contains(got, string(PushFailed)) || strings.Contains(got, string(CommitPushed)) {
+		t.Errorf("events were %s, want %s and not %s", got, PushFailed, CommitPushed)
+	}
+	if after := runGit(t, origin, "rev-parse", "master"); after != before {
+		t.Errorf("origin's master moved from %s to %s despite the failed push", before, after)
+	}
+	// The unpushed commit is reapplied on top of origin's head, to be pushed along with the next run's.
+	if got := originFile(t, filepath.Join(r.master.dir, ".git"), "master", "now.txt"); got == "" {
+		t.Error("the run's commit was dropped from master after the failed push")
+	}
+}
+
+func TestGitBinaryAndConfig(t *testing.T) {
+	setUpGit(t)
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "invocations.log")
+	wrapper := filepath.Join(dir, "git-wrapper")
+	writeFile(t, wrapper, fmt.Sprintf("#!/bin/sh\necho \"$GIT_CONFIG_GLOBAL $GIT_CONFIG_NOSYSTEM $*\" >> %s\nexec %s \"$@\"\n", log, realGit))
+	if err := os.Chmod(wrapper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "gitconfig")
+	writeFile(t, config, "[crony]\n\tsetting = configured\n")
+	setFlag(t, "git_binary", wrapper)
+	setFlag(t, "git_config", config)
+
+	out, err := execGit{}.Run(dir, "config", "crony.setting")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != "configured" {
+		t.Errorf("git read crony.setting as %q, want %q from -git_config", got, "configured")
+	}
+	logged, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(logged), config+" 1 config crony.setting\n"; got != want {
+		t.Errorf("-git_binary was run as %q, want %q", got, want)
+	}
+}
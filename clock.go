@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+)
+
+// realClock is a crontab.Clock that follows real time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// fastClock is a crontab.Clock that starts at a given time, then runs some factor faster than real time.
+type fastClock struct {
+	start, realStart time.Time
+	speed            float64
+}
+
+func newFastClock(start time.Time, speed float64) *fastClock {
+	return &fastClock{start: start, realStart: time.Now(), speed: speed}
+}
+
+func (c *fastClock) Now() time.Time {
+	return c.start.Add(time.Duration(float64(time.Since(c.realStart)) * c.speed))
+}
+
+func (c *fastClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	go func() {
+		<-time.After(time.Duration(float64(d) / c.speed))
+		ch <- c.Now()
+	}()
+	return ch
+}
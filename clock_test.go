@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+// clockExecutor is an Executor that records, instead of running each command, the time on a clock at which it's run.
+type clockExecutor struct {
+	clock crontab.Clock
+
+	mu   sync.Mutex
+	runs []clockRun
+}
+
+// clockRun is a run of a command recorded by a clockExecutor.
+type clockRun struct {
+	command string
+	at      time.Time
+}
+
+func (e *clockExecutor) Execute(ctx context.Context, j job, dir string, env []string) ([]byte, int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.runs = append(e.runs, clockRun{j.Command, e.clock.Now()})
+	return nil, 0, nil
+}
+
+func (e *clockExecutor) recorded() []clockRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]clockRun(nil), e.runs...)
+}
+
+func TestFastClockFastForwardsADay(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 */6 * * * ./quarterly\n30 9 * * * ./daily\n"})
+	start := time.Date(2026, time.October, 14, 23, 0, 0, 0, time.UTC)
+	// Six hours a second, so that a day passes in four.
+	clock := newFastClock(start, 6*60*60)
+	executor := &clockExecutor{clock: clock}
+	newTestManager(t, execGit{}, executor, clock, origin)
+
+	want := []string{
+		"2026-10-15T00:00 ./quarterly",
+		"2026-10-15T06:00 ./quarterly",
+		"2026-10-15T09:30 ./daily",
+		"2026-10-15T12:00 ./quarterly",
+		"2026-10-15T18:00 ./quarterly",
+	}
+	eventually(t, "a simulated day didn't pass", func() bool { return len(executor.recorded()) >= len(want) })
+	runs := executor.recorded()[:len(want)]
+	var got []string
+	for _, run := range runs {
+		// Allow for the real time taken to start each run, sped up along with everything else.
+		got = append(got, fmt.Sprintf("%s %s", run.at.Truncate(time.Hour/2).Format("2006-01-02T15:04"), run.command))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("over a simulated day, ran:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
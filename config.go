@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	configPath = flag.String("config", "",
+		"File of flag settings, one name=value per line, applied at startup to flags not given on the command line; "+
+			"it's re-read on SIGHUP or POST /reload, applying any changes to the flags that can be reloaded. "+
+			"If it's named *.json, it's a JSON Config, which can also list the repos to manage")
+)
+
+// reloadable lists the flags whose changes take effect when -config is reloaded, without restarting crony.
+// Others are only read at startup, or when a repo is added.
+var reloadable = map[string]bool{
+	"pull_frequency":       true,
+	"max_concurrent_jobs":  true,
+	"max_concurrent_pulls": true,
+	"lock_timeout":         true,
+	"kill_grace_period":    true,
+	"shutdown_timeout":     true,
+	"check_remote_head":    true,
+	"clone_attempts":       true,
+	"clone_retry_delay":    true,
+	"push_allow_branches":  true,
+}
+
+// commandLineFlags are the flags given on the command line, which override -config, even when it's reloaded.
+var commandLineFlags = make(map[string]bool)
+
+// lastConfig holds the settings in -config as of when it was last loaded, so that reloading only applies changes,
+// and lastRepos the repos it listed.
+var (
+	lastConfig map[string]string
+	lastRepos  []RepoConfig
+)
+
+// reloadMu serializes reloads of -config, which may come from SIGHUP and POST /reload at once.
+var reloadMu sync.Mutex
+
+// reloadableSettings holds the values of the reloadable flags as of the last (re)load of -config.
+// Since a reload sets the flags while jobs and pulls are running, those read them through settings,
+// rather than from the flags themselves.
+type reloadableSettings struct {
+	pullFrequency      time.Duration
+	maxConcurrentJobs  int
+	maxConcurrentPulls int
+	lockTimeout        time.Duration
+	killGracePeriod    time.Duration
+	shutdownTimeout    time.Duration
+	checkRemoteHead    bool
+	cloneAttempts      int
+	cloneRetryDelay    time.Duration
+	pushAllowBranches  string
+}
+
+var currentSettings atomic.Pointer[reloadableSettings]
+
+// settings returns the values of the reloadable flags as last published by publishSettings,
+// or, if they haven't been yet, as they are now.
+func settings() *reloadableSettings {
+	if s := currentSettings.Load(); s != nil {
+		return s
+	}
+	return snapshotSettings()
+}
+
+// publishSettings makes the reloadable flags' current values the ones settings returns.
+// It's called only after the flags have been set, by the goroutine setting them.
+func publishSettings() {
+	currentSettings.Store(snapshotSettings())
+}
+
+func snapshotSettings() *reloadableSettings {
+	return &reloadableSettings{
+		pullFrequency:      *pullFrequency,
+		maxConcurrentJobs:  *maxConcurrentJobs,
+		maxConcurrentPulls: *maxConcurrentPulls,
+		lockTimeout:        *lockTimeout,
+		killGracePeriod:    *killGracePeriod,
+		shutdownTimeout:    *shutdownTimeout,
+		checkRemoteHead:    *checkRemoteHead,
+		cloneAttempts:      *cloneAttempts,
+		cloneRetryDelay:    *cloneRetryDelay,
+		pushAllowBranches:  *pushAllowBranches,
+	}
+}
+
+// Config is the contents of -config. A file of name=value lines only sets flags;
+// a JSON one can also list the repos to manage, e.g.
+//
+//	{
+//		"flags": {"max_concurrent_jobs": "4"},
+//		"repos": [
+//			{"origin": "git@github.com:me/jobs.git", "mirrors": ["https://mirror.example.com/jobs.git"]},
+//			{"origin": "git@github.com:me/reports.git", "crontab": "ops/crontab", "pull_frequency": "1m",
+//			 "ssh_key": "/etc/crony/reports_key", "after": ["git@github.com:me/jobs.git"]}
+//		]
+//	}
+type Config struct {
+	// Settings of flags, by name, applied to flags not given on the command line.
+	Flags map[string]string `json:"flags"`
+	// Repos to manage, along with any given as arguments.
+	Repos []RepoConfig `json:"repos"`
+}
+
+// RepoConfig describes a repo to manage, with settings of its own that take the place of the flags'.
+type RepoConfig struct {
+	// URL of the repo, which also names it unless Name is set.
+	Origin string `json:"origin"`
+	Name   string `json:"name,omitempty"`
+	// URLs of mirrors of the repo to fetch from when it can't be reached.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Path of the crontab in the repo; if empty, "crontab".
+	Crontab string `json:"crontab,omitempty"`
+	// Branch to track and ref to read the crontab from; if empty, -branch and -crontab_ref.
+	Branch     string `json:"branch,omitempty"`
+	CrontabRef string `json:"crontab_ref,omitempty"`
+	// How often to pull the repo, e.g. "1m"; if empty, -pull_frequency.
+	PullFrequency string `json:"pull_frequency,omitempty"`
+	// Private key with which git authenticates to the repo and its mirrors over SSH.
+	SSHKey string `json:"ssh_key,omitempty"`
+	// Names of other repos in the config whose crontabs must be loaded before this one's jobs start,
+	// e.g. one with scripts they use.
+	After []string `json:"after,omitempty"`
+
+	pullFrequency time.Duration
+}
+
+// name returns the name of the repo c describes.
+func (c RepoConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Origin
+}
+
+// readConfig reads the file at path. If it's named *.json, it's a JSON Config;
+// otherwise it only has flag settings, one name=value per line.
+// Blank lines and lines starting with "#" are ignored, and a leading "-" on a flag's name is optional.
+func readConfig(path string) (*Config, error) {
+	if strings.HasSuffix(path, ".json") {
+		return readJSONConfig(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		nameValue := strings.SplitN(line, "=", 2)
+		if len(nameValue) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name=value", path, n)
+		}
+		name := strings.TrimLeft(strings.TrimSpace(nameValue[0]), "-")
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: no such flag -%s", path, n, name)
+		}
+		settings[name] = strings.TrimSpace(nameValue[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &Config{Flags: settings}, nil
+}
+
+// readJSONConfig reads the JSON Config in the file at path, checking it for mistakes,
+// and reporting every one it finds rather than just the first.
+func readJSONConfig(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	var config Config
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	var errs []string
+	var names []string
+	for name := range config.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	settings := make(map[string]string)
+	for _, name := range names {
+		if flag.Lookup(strings.TrimLeft(name, "-")) == nil {
+			errs = append(errs, fmt.Sprintf("no such flag -%s", name))
+		}
+		settings[strings.TrimLeft(name, "-")] = config.Flags[name]
+	}
+	config.Flags = settings
+	seen := make(map[string]bool)
+	for i := range config.Repos {
+		c := &config.Repos[i]
+		where := fmt.Sprintf("repos[%d]", i)
+		if c.Origin == "" {
+			errs = append(errs, where+": no origin")
+			continue
+		}
+		where += " (" + c.name() + ")"
+		if seen[c.name()] {
+			errs = append(errs, where+": listed more than once")
+		}
+		seen[c.name()] = true
+		if c.Crontab != "" && (path.IsAbs(c.Crontab) || path.Clean(c.Crontab) != c.Crontab || strings.HasPrefix(c.Crontab, "../")) {
+			errs = append(errs, fmt.Sprintf("%s: crontab must be a clean path within the repo: %s", where, c.Crontab))
+		}
+		if c.PullFrequency != "" {
+			if c.pullFrequency, err = time.ParseDuration(c.PullFrequency); err != nil || c.pullFrequency <= 0 {
+				errs = append(errs, fmt.Sprintf("%s: pull_frequency must be a positive duration: %s", where, c.PullFrequency))
+			}
+		}
+	}
+	errs = append(errs, checkRepoOrder(config.Repos, seen)...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %s", file, strings.Join(errs, "; "))
+	}
+	return &config, nil
+}
+
+// checkRepoOrder checks that each of repos is only to start after repos among them, whose names are in names,
+// and that none of them is to start after itself, even by way of others, which would never start.
+func checkRepoOrder(repos []RepoConfig, names map[string]bool) []string {
+	var errs []string
+	after := make(map[string][]string)
+	for _, c := range repos {
+		for _, name := range c.After {
+			if !names[name] {
+				errs = append(errs, fmt.Sprintf("%s: after names a repo that isn't in the config: %s", c.name(), name))
+			}
+		}
+		after[c.name()] = c.After
+	}
+	// Walk the repos each one must start after, depth first, looking for a way back to one already on the path.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) bool
+	visit = func(name string, path []string) bool {
+		switch state[name] {
+		case visiting:
+			for path[0] != name {
+				path = path[1:]
+			}
+			errs = append(errs, fmt.Sprintf("repos can't start until they've started: %s", strings.Join(append(path, name), " after ")))
+			return false
+		case visited:
+			return true
+		}
+		state[name] = visiting
+		for _, next := range after[name] {
+			if !visit(next, append(path, name)) {
+				return false
+			}
+		}
+		state[name] = visited
+		return true
+	}
+	for _, c := range repos {
+		if !visit(c.name(), nil) {
+			break
+		}
+	}
+	return errs
+}
+
+// loadConfig applies the settings in -config, if it's set, to every flag that wasn't given on the command line,
+// returning the repos it lists.
+func loadConfig() ([]RepoConfig, error) {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	if *configPath == "" {
+		return nil, nil
+	}
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	lastConfig, lastRepos = config.Flags, config.Repos
+	for name, value := range config.Flags {
+		if commandLineFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid -%s in %s: %s", name, *configPath, err)
+		}
+	}
+	return config.Repos, nil
+}
+
+// reloadConfig re-reads -config, applying any settings of reloadable flags that changed since it was last loaded to m,
+// and warning about changes to others, and to its repos. Flags whose settings were removed keep their values.
+func reloadConfig(m *Manager) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if *configPath == "" {
+		return fmt.Errorf("no -config to reload")
+	}
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(config.Repos, lastRepos) {
+		glog.Warningf("not changing the repos crony manages; changes to them in %s only take effect on restart", *configPath)
+	}
+	values := config.Flags
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []string
+	for _, name := range names {
+		value := values[name]
+		if previous, ok := lastConfig[name]; commandLineFlags[name] || ok && previous == value {
+			continue
+		}
+		if !reloadable[name] {
+			glog.Warningf("not changing -%s to %s; it only takes effect on restart", name, value)
+			continue
+		}
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid -%s: %s", name, err))
+			// Keep the last good setting, so that fixing it is seen as a change.
+			// A flag that fails to parse may still have been changed, e.g. durations to 0, so put it back.
+			flag.Set(name, old)
+			values[name] = lastConfig[name]
+			continue
+		}
+		glog.Infof("reloaded -%s=%s", name, value)
+	}
+	lastConfig = values
+	publishSettings()
+	m.SetMaxConcurrentJobs(settings().maxConcurrentJobs)
+	m.SetMaxConcurrentPulls(settings().maxConcurrentPulls)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
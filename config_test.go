@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeConfig points -config at a file holding contents for the rest of the test, as if it hadn't been loaded yet,
+// so that reloading it applies all of its settings, restoring the reloadable flags and settings afterwards.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "crony.conf")
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := *snapshotSettings()
+	savedPath, savedConfig, savedRepos := *configPath, lastConfig, lastRepos
+	t.Cleanup(func() {
+		*pullFrequency, *maxConcurrentJobs, *maxConcurrentPulls = saved.pullFrequency, saved.maxConcurrentJobs, saved.maxConcurrentPulls
+		*lockTimeout, *killGracePeriod, *shutdownTimeout = saved.lockTimeout, saved.killGracePeriod, saved.shutdownTimeout
+		*checkRemoteHead, *cloneAttempts, *cloneRetryDelay = saved.checkRemoteHead, saved.cloneAttempts, saved.cloneRetryDelay
+		*pushAllowBranches = saved.pushAllowBranches
+		*configPath, lastConfig, lastRepos = savedPath, savedConfig, savedRepos
+		publishSettings()
+	})
+	*configPath, lastConfig, lastRepos = file, nil, nil
+	return file
+}
+
+func TestReloadChangesPullFrequency(t *testing.T) {
+	file := writeConfig(t, "pull_frequency=1m\n")
+	if err := reloadConfig(NewManager(0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := settings().pullFrequency; got != time.Minute {
+		t.Fatalf("pull frequency after loading is %s, want 1m", got)
+	}
+	repo := &repo{}
+	if got := pullInterval(repo); got < time.Minute || got >= time.Minute+6*time.Second {
+		t.Fatalf("pull interval after loading is %s, want 1m plus up to 10%% jitter", got)
+	}
+
+	if err := os.WriteFile(file, []byte("pull_frequency=10s\nmax_concurrent_jobs=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(0)
+	if err := reloadConfig(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := pullInterval(repo); got < 10*time.Second || got >= 11*time.Second {
+		t.Errorf("pull interval after reloading is %s, want 10s plus up to 10%% jitter", got)
+	}
+	if got := cap(m.slots); got != 2 {
+		t.Errorf("job slots after reloading are %d, want 2", got)
+	}
+}
+
+func TestReloadKeepsLastGoodSetting(t *testing.T) {
+	file := writeConfig(t, "lock_timeout=1m\n")
+	if err := reloadConfig(NewManager(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("lock_timeout=soon\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(NewManager(0)); err == nil {
+		t.Fatal("reloading an invalid -lock_timeout succeeded")
+	}
+	if got := settings().lockTimeout; got != time.Minute {
+		t.Errorf("lock timeout after a bad reload is %s, want 1m", got)
+	}
+}
+
+// TestConcurrentReloads reloads from several goroutines while others read the settings;
+// run with -race to check that they're safe to.
+func TestConcurrentReloads(t *testing.T) {
+	writeConfig(t, "pull_frequency=1m\nkill_grace_period=5s\n")
+	if err := reloadConfig(NewManager(0)); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := reloadConfig(m); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if s := settings(); s.pullFrequency != time.Minute || s.killGracePeriod != 5*time.Second {
+					t.Errorf("read settings %+v, want those in -config", *s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReadJSONConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "crony.json")
+	writeFile(t, file, `{
+	"flags": {"-max_concurrent_jobs": "4"},
+	"repos": [
+		{"origin": "git@example.com:ops/reports.git", "name": "reports", "crontab": "cron/reports",
+			"branch": "main", "pull_frequency": "30s", "ssh_key": "/etc/crony/reports.key",
+			"mirrors": ["https://mirror.example.com/ops/reports.git"]},
+		{"origin": "git@example.com:ops/scripts.git", "after": ["reports"]}
+	]
+}`)
+	config, err := readConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(config.Flags); got != "map[max_concurrent_jobs:4]" {
+		t.Errorf("flags are %s, want max_concurrent_jobs=4", got)
+	}
+	want := []RepoConfig{
+		{Origin: "git@example.com:ops/reports.git", Name: "reports", Crontab: "cron/reports", Branch: "main",
+			PullFrequency: "30s", SSHKey: "/etc/crony/reports.key", Mirrors: []string{"https://mirror.example.com/ops/reports.git"},
+			pullFrequency: 30 * time.Second},
+		{Origin: "git@example.com:ops/scripts.git", After: []string{"reports"}},
+	}
+	if !reflect.DeepEqual(config.Repos, want) {
+		t.Errorf("repos are %+v, want %+v", config.Repos, want)
+	}
+	if got := config.Repos[1].name(); got != "git@example.com:ops/scripts.git" {
+		t.Errorf("repo without a name is named %s, want its origin", got)
+	}
+
+	writeFile(t, file, `{
+	"flags": {"no_such_flag": "1"},
+	"repos": [
+		{"origin": "a", "crontab": "../crontab", "pull_frequency": "often"},
+		{"origin": "a"},
+		{"crontab": "crontab"},
+		{"origin": "b", "after": ["c"]}
+	]
+}`)
+	_, err = readConfig(file)
+	if err == nil {
+		t.Fatal("read an invalid config")
+	}
+	for _, want := range []string{
+		"no such flag -no_such_flag",
+		"repos[0] (a): crontab must be a clean path within the repo: ../crontab",
+		"repos[0] (a): pull_frequency must be a positive duration: often",
+		"repos[1] (a): listed more than once",
+		"repos[2]: no origin",
+		"b: after names a repo that isn't in the config: c",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error reading an invalid config is %q, want it to include %q", err, want)
+		}
+	}
+
+	writeFile(t, file, `{"repos": [{"origin": "a", "ssh_keys": "typo"}]}`)
+	if _, err := readConfig(file); err == nil || !strings.Contains(err.Error(), "ssh_keys") {
+		t.Errorf("reading a config with an unknown field returned %v, want an error naming it", err)
+	}
+}
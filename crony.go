@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"math/rand"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -15,121 +28,1110 @@ import (
 var (
 	pullFrequency = flag.Duration("pull_frequency", 5*time.Minute,
 		"Rate at which to check for upstream changes to the crontab")
+	mergeStrategyOption = flag.String("merge_strategy_option", "",
+		"Strategy option passed as -X when rebasing a job's commit onto master, e.g. \"theirs\" to prefer "+
+			"the job's changes on conflict; this silently discards one side of the conflict, so use with care")
+	maxHistoryDepth = flag.Int("max_history_depth", 0,
+		"If positive, periodically squash master's oldest commits and force-push, "+
+			"so that its history is at most this many commits long; only commits crony made since "+
+			"the most recent one someone else made are squashed, so history may be kept longer")
+	checkRemoteHead = flag.Bool("check_remote_head", true,
+		"Compare origin's HEAD with the local HEAD using ls-remote before each pull, skipping the pull if they match")
+	strictCrontab = flag.Bool("strict_crontab", false,
+		"Reject crontabs containing entries without a command, or with schedules that can never fire, such as \"0 0 30 2 *\"")
+	verifyCrontab = flag.Bool("verify_crontab", false,
+		"Only schedule a crontab if the last commit to change it has a valid GPG signature from a key in crony's keyring, "+
+			"otherwise keeping the previous crontab")
+	crontabSeconds = flag.Bool("crontab_seconds", false,
+		"Expect crontab schedules with 7 fields, as in Quartz: second minute hour day month weekday year")
+	systemCrontab = flag.Bool("system_crontab", false,
+		"Expect a user between each crontab entry's schedule and its command, as in /etc/cron.d, "+
+			"and run the command as that user; crony must run as root to run commands as other users")
+	historyRewriteName = flag.String("on_history_rewrite", string(rewritePreserve),
+		"What to do with local commits that haven't been pushed when origin's history has been rewritten: "+
+			"\"preserve\" them by cherry-picking them onto origin's history, \"reset\" to origin's history and drop them, "+
+			"or \"abort\", leaving them alone and pausing the repo")
+	pullModeName = flag.String("pull_mode", string(pullRebase),
+		"How to incorporate origin's changes when pulling: \"rebase\" local commits onto origin's, "+
+			"fast-forward only and fail if history has diverged (\"ff-only\"), or \"reset\" to origin's history")
+	dedupEntries = flag.Bool("dedup_entries", false,
+		"Only schedule the first of several identical entries in a crontab, rather than running its command "+
+			"once for each, warning about the rest either way")
+	keepFailedBranches = flag.Bool("keep_failed_branches", false,
+		"Keep the branch of each failed run, including any output committed to it, as crony/failed/<command>/<time>, "+
+			"and push it to origin for inspection; kept branches are listed in /status, and must be deleted by hand")
+	pushAllowBranches = flag.String("push_allow_branches", "",
+		"If set, a comma-separated list of the only branches of origin crony may push to, each of which may be a glob, "+
+			"e.g. main,crony/failed/*; commits that would be pushed anywhere else are kept in the local clone instead")
+	cloneAttempts = flag.Int("clone_attempts", 3,
+		"How many times to try cloning each repo before giving up on it")
+	cloneRetryDelay = flag.Duration("clone_retry_delay", 5*time.Second,
+		"How long to wait before retrying a failed clone; each retry waits twice as long as the last")
+	workdirPoolSize = flag.Int("workdir_pool_size", 0,
+		"Number of job workdirs per repo to keep after use, to be reset and reused by later jobs")
+	maxConcurrentJobs = flag.Int("max_concurrent_jobs", 0,
+		"If positive, the most jobs to run at once across all repos; further jobs wait for a free slot")
+	maxConcurrentPulls = flag.Int("max_concurrent_pulls", 0,
+		"If positive, the most pulls from origin to run at once across all repos; further pulls wait their turn")
+	commitSubject = flag.String("commit_subject", "crony: {slug} (exit {exit})",
+		"Subject line of each run's commit, in which {command} is replaced by the command, {slug} by a short form of it, "+
+			"and {exit} by its exit code; the command and its output follow in the body")
+	branch = flag.String("branch", "",
+		"Branch of each repo to which jobs commit their changes; if empty, origin's default branch")
+	crontabRef = flag.String("crontab_ref", "",
+		"Ref, such as a tag, from which to read each repo's crontab, fetching it from origin on each pull; "+
+			"if empty, the crontab is read from the branch jobs commit to")
+	killGracePeriod = flag.Duration("kill_grace_period", 10*time.Second,
+		"How long a command has to exit after being sent SIGTERM, on timing out or shutdown, before it's sent SIGKILL")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 0,
+		"How long to wait on shutdown for running commands to finish before terminating them; if not positive, waits indefinitely")
+	exitWhenIdle = flag.Duration("exit_when_idle", 0,
+		"If positive, shut down and exit once no job is running, and none is due to run within this long, "+
+			"e.g. to run whatever's due in CI and then stop")
+	simulateSpeed = flag.Float64("simulate_speed", 0,
+		"If positive, simulate running each crontab this many times faster than real time, logging each run instead of running it")
+	simulateStart = flag.String("simulate_start", "",
+		"Time at which a simulation starts, in RFC 3339 format, e.g. \"2006-01-02T15:04:05Z\"; if empty, the current time")
+	startPaused = flag.Bool("start_paused", false,
+		"Start with every repo paused, skipping scheduled runs until resumed with POST /resume")
+	lockTimeout = flag.Duration("lock_timeout", time.Hour,
+		"How long a job waits for its named lock before skipping the run; if not positive, waits indefinitely")
+	crontabValidator = flag.String("crontab_validator", "",
+		"Command run in each repo's crontab clone with a newly pulled crontab on stdin, e.g. a linter; "+
+			"if it fails, the crontab is rejected, and the last one applied keeps running")
+	precondition = flag.String("precondition", "",
+		"Command run in each repo after loading its crontab, e.g. to check that a mount is present; "+
+			"while it fails, none of the repo's jobs are scheduled, and it's retried with backoff")
+	onShutdown = flag.String("on_shutdown", "",
+		"Command run in each repo on shutdown, once running jobs have finished and before its clone is removed, "+
+			"e.g. to release external locks; its changes aren't committed")
+	heartbeatInterval = flag.Duration("heartbeat", 0,
+		"If positive, commit and push the time to "+heartbeatFile+" in each repo this often, whether or not jobs change anything, "+
+			"so that a stalled crony can be spotted by a stale heartbeat")
+	onShutdownTimeout = flag.Duration("on_shutdown_timeout", time.Minute,
+		"How long -on_shutdown may run in each repo before it's terminated; if not positive, it's never terminated")
 )
 
-// Pull latest commit from repo's origin, then parse its crontab and return it on the passed channel.
-func pullCrontab(repo *repo, crontabUpdates chan<- []crontab.Entry) error {
+// fileMode is a flag.Value for permission bits, given in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return fmt.Errorf("expected octal permission bits, e.g. 0644")
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+var (
+	workdirMode  = fileMode(0700)
+	failFileMode = fileMode(0644)
+)
+
+// byteSize is a flag.Value for a number of bytes, optionally given with a K, M, or G suffix.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a number of bytes, optionally with a K, M, or G suffix, e.g. 10G")
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+var maxDisk byteSize
+
+func init() {
+	flag.Var(&workdirMode, "workdir_mode",
+		"Permissions of the directories repos are cloned and jobs are run in; "+
+			"anything more permissive than 0700 lets other users read job output and anything else in the repo")
+	flag.Var(&failFileMode, "fail_file_mode", "Permissions of the .fail file written when a job fails")
+	flag.Var(&maxDisk, "max_disk",
+		"If positive, the most disk space, in bytes or with a K, M, or G suffix, that clones and job workdirs may use in total; "+
+			"cloning a repo or starting a job that would need more fails instead")
+}
+
+// errHistoryRewritten is returned when origin's history has been rewritten, and -on_history_rewrite is "abort".
+var errHistoryRewritten = errors.New("origin's history has been rewritten; not overwriting local history")
+
+// Recover from being unable to incorporate origin's changes into repo's master, presumably because its history
+// was rewritten, according to the repo's rewrite mode.
+// upstream is origin's head as of before the attempt, from which to tell which local commits haven't been pushed.
+func recoverHistory(repo *repo, upstream string) error {
+	glog.Warningf("couldn't pull %s; was origin's history rewritten?", repo.name)
+	switch repo.rewriteMode {
+	case rewriteAbort:
+		return errHistoryRewritten
+	case rewritePreserve:
+		if upstream != "" {
+			glog.Warningf("overwriting local head with origin's, then reapplying unpushed commits...")
+			return repo.master.ResetPreserving(upstream)
+		}
+		glog.Warningf("couldn't tell which commits haven't been pushed, so not reapplying any")
+	}
+	glog.Warningf("overwriting local head with origin's...")
+	return repo.master.FetchHead()
+}
+
+// PullErrorKind classifies why pulling a crontab failed.
+type PullErrorKind string
+
+// Kinds of PullError.
+const (
+	// Origin couldn't be reached, which will likely fix itself.
+	PullNetwork PullErrorKind = "network"
+	// Git failed for some other reason.
+	PullGit PullErrorKind = "git"
+	// The repo has no crontab.
+	PullFileMissing PullErrorKind = "file_missing"
+	// The crontab couldn't be parsed, which won't fix itself until someone changes it.
+	PullParse PullErrorKind = "parse"
+	// The crontab isn't signed, and -verify_crontab requires it to be.
+	PullUntrusted PullErrorKind = "untrusted"
+	// -crontab_validator failed on the crontab.
+	PullRejected PullErrorKind = "rejected"
+)
+
+// PullError is returned when pulling a crontab fails, saying which kind of failure it was,
+// so that transient failures can be told apart from those that need someone to intervene.
+type PullError struct {
+	Kind PullErrorKind
+	Err  error
+}
+
+func (e *PullError) Error() string {
+	return e.Err.Error()
+}
+
+// networkErrors are messages by which git says it couldn't reach a remote.
+var networkErrors = []string{
+	"Could not resolve host",
+	"Could not read from remote repository",
+	"unable to access",
+	"Connection refused",
+	"Connection timed out",
+	"Network is unreachable",
+	"The remote end hung up",
+	"early EOF",
+}
+
+// gitPullError classifies an error from a git operation that talks to origin.
+func gitPullError(err error) *PullError {
+	for _, msg := range networkErrors {
+		if strings.Contains(err.Error(), msg) {
+			return &PullError{PullNetwork, err}
+		}
+	}
+	return &PullError{PullGit, err}
+}
+
+// Pull latest commit from repo's origin into its crontab clone, then parse its crontab and return it on the passed channel.
+// Master isn't touched, so this works even while a job's merge or push is stuck.
+// Any error is a *PullError.
+func pullCrontab(m *Manager, repo *repo, queue *crontabQueue) error {
+	c := repo.crontab
+	if settings().checkRemoteHead {
+		upToDate, err := c.UpToDate()
+		if err != nil {
+			glog.V(1).Infof("couldn't compare %s with origin, pulling anyway: %s", repo.name, err)
+		}
+		if upToDate {
+			glog.V(1).Infof("%s matches origin, skipping pull", repo.name)
+			return readCrontab(m, repo, queue)
+		}
+	}
+	if err := c.FetchHead(); err != nil {
+		return gitPullError(err)
+	}
+	return readCrontab(m, repo, queue)
+}
+
+// Pull latest commits from repo's origin into its master, from which jobs branch and into which they're merged.
+func pullMaster(repo *repo) error {
 	m := repo.master
+	if settings().checkRemoteHead {
+		upToDate, err := m.UpToDate()
+		if err != nil {
+			glog.V(1).Infof("couldn't compare %s's master with origin, pulling anyway: %s", repo.name, err)
+		}
+		if upToDate {
+			return nil
+		}
+	}
+	upstream, err := m.Upstream()
+	if err != nil {
+		glog.Warningf("couldn't determine origin's head for %s: %s", repo.name, err)
+	}
 	if err := m.Pull(); err != nil {
-		glog.Warningf("couldn't pull %s; was origin's history rewritten?", repo.name)
-		glog.Warningf("overwriting local head with origin's...")
-		if err := m.FetchHead(); err != nil {
+		if repo.pullMode == pullFastForwardOnly {
+			return fmt.Errorf("couldn't fast-forward %s to origin; has history diverged? %s", repo.name, err)
+		}
+		if err := recoverHistory(repo, upstream); err != nil {
 			return err
 		}
 	}
-	contents, err := ioutil.ReadFile(path.Join(m.dir, "crontab"))
-	if err != nil {
-		return err
+	return nil
+}
+
+// Parse the crontab in repo's crontab clone, or at its crontab ref if it has one,
+// along with the files it includes, and queue it to be applied.
+// Files are read as of a single commit, rather than from the clone's working tree,
+// so that a crontab and the files it includes are never read partway through a pull.
+// If -verify_crontab is set, the crontab is only returned if it and each file it includes are signed,
+// and if -crontab_validator is set, only if it passes.
+// Any error is a *PullError.
+func readCrontab(m *Manager, repo *repo, queue *crontabQueue) error {
+	var fsys fs.FS
+	var rev string
+	var err error
+	if repo.crontabRef != "" {
+		fsys, rev, err = repo.crontab.FSAt(repo.crontabRef)
+	} else {
+		fsys, rev, err = repo.crontab.FSAtHead()
 	}
-	entries, err := crontab.ParseCrontab(string(contents))
 	if err != nil {
-		return err
+		return gitPullError(err)
+	}
+	read := &readFS{fsys: fsys}
+	options := crontab.ParseOptions{Strict: *strictCrontab, Seconds: *crontabSeconds, System: *systemCrontab}
+	entries, err := options.ParseCrontabFS(read, repo.crontabPath)
+	var sidecar map[string]map[string]string
+	if err == nil {
+		sidecar, err = readSidecar(read)
+	}
+	if *verifyCrontab {
+		for _, file := range read.files {
+			if err := repo.crontab.VerifyLastCommit(rev, file); err != nil {
+				return &PullError{PullUntrusted, fmt.Errorf("not trusting %s: %s", file, err)}
+			}
+		}
 	}
+	if os.IsNotExist(err) {
+		return &PullError{PullFileMissing, err}
+	} else if read.err != nil {
+		return gitPullError(read.err)
+	} else if err != nil {
+		return &PullError{PullParse, err}
+	}
+	// An empty crontab is more likely to have been caught mid-write than meant to stop every job.
+	if len(bytes.TrimSpace(read.contents[0])) == 0 {
+		return &PullError{PullParse, fmt.Errorf("crontab is empty; to stop every job, leave a comment in it")}
+	}
+	if err := validateCrontab(m, repo, read.contents[0]); err != nil {
+		return &PullError{PullRejected, err}
+	}
+	applySidecar(entries, sidecar)
 	glog.Infof("crontab up-to-date")
-	glog.V(2).Infof("Got crontab:\n%s", string(contents))
-	crontabUpdates <- entries
+	queue.push(entries)
+	return nil
+}
+
+// validateCrontab runs -crontab_validator, if it's set, in repo's crontab clone with contents on stdin,
+// returning an error if it fails.
+// It's terminated if it's still running after -pull_frequency.
+func validateCrontab(m *Manager, repo *repo, contents []byte) error {
+	if *crontabValidator == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/bash", "-c", *crontabValidator)
+	cmd.Dir = repo.crontab.dir
+	cmd.Stdin = bytes.NewReader(contents)
+	out, err := runCommand(cmd, settings().pullFrequency, m.terminating)
+	if err != nil {
+		return fmt.Errorf("crontab rejected by -crontab_validator: %s: %s", err, strings.TrimSpace(string(out)))
+	}
 	return nil
 }
 
+// readFS records the files read from a crontab's file system along with their contents,
+// and the first error reading one other than its absence.
+type readFS struct {
+	fsys     fs.FS
+	files    []string
+	contents [][]byte
+	err      error
+}
+
+func (r *readFS) Open(name string) (fs.File, error) {
+	return r.fsys.Open(name)
+}
+
+func (r *readFS) ReadFile(name string) ([]byte, error) {
+	contents, err := fs.ReadFile(r.fsys, name)
+	if err == nil {
+		r.files = append(r.files, name)
+		r.contents = append(r.contents, contents)
+		glog.V(2).Infof("Got %s:\n%s", name, string(contents))
+	} else if !os.IsNotExist(err) && r.err == nil {
+		r.err = err
+	}
+	return contents, err
+}
+
+// crontabQueue holds the latest crontab pulled for a repo until it's applied,
+// so that pulling never waits on applying, and a crontab that hasn't been applied yet is superseded by a newer one.
+type crontabQueue struct {
+	updates chan []crontab.Entry
+
+	mu          sync.Mutex
+	superseded  int
+	lastApplied time.Time
+}
+
+func newCrontabQueue() *crontabQueue {
+	return &crontabQueue{updates: make(chan []crontab.Entry, 1)}
+}
+
+// push queues entries to be applied, replacing any crontab still waiting.
+// Only one goroutine may push to a queue.
+func (q *crontabQueue) push(entries []crontab.Entry) {
+	for {
+		select {
+		case q.updates <- entries:
+			return
+		default:
+		}
+		select {
+		case <-q.updates:
+			q.mu.Lock()
+			q.superseded++
+			q.mu.Unlock()
+		default:
+		}
+	}
+}
+
+// applied records that a crontab taken from the queue has been applied.
+func (q *crontabQueue) applied() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastApplied = time.Now()
+}
+
+// stats returns how many crontabs are waiting to be applied, how many were superseded before they were,
+// and when a crontab was last applied.
+func (q *crontabQueue) stats() (pending, superseded int, lastApplied time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.updates), q.superseded, q.lastApplied
+}
+
 // Spin up a background goroutine to periodically pull the latest crontab,
-// sending it over the returned channel after each check.
-func watchCrontab(repo *repo) <-chan []crontab.Entry {
-	crontabUpdates := make(chan []crontab.Entry)
-	go func() {
-		ticker := time.NewTicker(*pullFrequency)
-		defer ticker.Stop()
-		if err := pullCrontab(repo, crontabUpdates); err != nil {
-			glog.Errorf("error pulling crontab for %s: %s", repo.name, err)
+// pushing it onto queue after each check, until m shuts down.
+func watchCrontab(m *Manager, repo *repo, queue *crontabQueue) {
+	m.goBackground(func() {
+		unreachable := 0
+		// Why the crontab was last rejected by -crontab_validator, if it was.
+		var rejection string
+		for {
+			if failedBack, err := repo.FailBack(); err != nil {
+				glog.Errorf("error switching %s back to fetching from origin: %s", repo.name, err)
+			} else if failedBack {
+				glog.Infof("%s can be reached again, fetching from it rather than its mirror", repo.name)
+			}
+			release, ok := m.pullSlot()
+			if !ok {
+				return
+			}
+			err := pullCrontab(m, repo, queue)
+			release()
+			if pullErr, ok := err.(*PullError); ok && pullErr.Kind == PullNetwork {
+				glog.Warningf("couldn't reach %s to pull crontab for %s, will retry: %s", repo.Source(), repo.name, err)
+				if unreachable++; unreachable >= failOverAfter && len(repo.origins) > 1 {
+					unreachable = 0
+					if source, err := repo.FailOver(); err != nil {
+						glog.Errorf("error switching %s to another mirror: %s", repo.name, err)
+					} else {
+						glog.Warningf("switched %s to fetching from %s", repo.name, source)
+					}
+				}
+			} else {
+				unreachable = 0
+				if err != nil {
+					glog.Errorf("error pulling crontab for %s: %s", repo.name, err)
+				}
+				// Alert once for each crontab rejected, rather than on every pull until it's fixed.
+				if pullErr, ok := err.(*PullError); ok && pullErr.Kind == PullRejected {
+					if err.Error() != rejection {
+						m.Events.publish(Event{Type: CrontabRejected, Repo: repo.name, Err: err})
+					}
+					rejection = err.Error()
+				} else if err == nil {
+					rejection = ""
+				}
+			}
+			checkHealth(repo, repo.crontab, "crontab clone", err)
+			m.recordPull(repo.name, err)
+			// Waiting afresh each time picks up any change to -pull_frequency from reloading -config.
+			select {
+			case <-time.After(pullInterval(repo)):
+			case <-m.stopping:
+				return
+			}
 		}
-		for _ = range ticker.C {
-			if err := pullCrontab(repo, crontabUpdates); err != nil {
-				glog.Errorf("error pulling crontab for %s: %s", repo.name, err)
+	})
+}
+
+// pullInterval returns how long to wait before repo's next pull: its pull frequency, or else -pull_frequency,
+// plus up to a tenth more at random, so that repos added at the same time drift apart rather than all pulling at once.
+func pullInterval(repo *repo) time.Duration {
+	d := settings().pullFrequency
+	if repo.pullFrequency > 0 {
+		d = repo.pullFrequency
+	}
+	if jitter := int64(d / 10); jitter > 0 {
+		d += time.Duration(rand.Int63n(jitter))
+	}
+	return d
+}
+
+// Spin up a background goroutine to periodically pull origin's latest commits into repo's master until m shuts down.
+// If origin's history was rewritten and the repo's rewrite mode says not to recover, the repo is paused.
+func watchMaster(m *Manager, repo *repo) {
+	m.goBackground(func() {
+		for {
+			select {
+			case <-time.After(pullInterval(repo)):
+			case <-m.stopping:
+				return
+			}
+			release, ok := m.pullSlot()
+			if !ok {
+				return
+			}
+			err := pullMaster(repo)
+			release()
+			if err == errHistoryRewritten {
+				glog.Errorf("pausing %s: %s", repo.name, err)
+				m.Pause(repo.name)
+			} else if err != nil {
+				glog.Errorf("error pulling master for %s: %s", repo.name, err)
+			}
+			// Pulls are skipped while master is up-to-date, so only failures count; branching for jobs counts successes.
+			if err != nil {
+				checkHealth(repo, repo.master, "master", err)
 			}
 		}
-	}()
-	return crontabUpdates
+	})
 }
 
-// Handle the incoming stream of parsed crontabs,
-// keeping the correct set of executeEntry worker goroutines running.
-func executeCrontab(repo *repo, crontabUpdates <-chan []crontab.Entry) {
-	var stopTime chan time.Time
-	for {
-		select {
-		case entries := <-crontabUpdates:
-			now := time.Now()
-			if stopTime != nil {
-				stopTime <- now
+// How many times in a row origin, or the mirror of it being fetched from, may be unreachable before switching to the next.
+const failOverAfter = 3
+
+// How many times in a row git may fail fatally in a clone before the clone is checked for corruption.
+const maxGitFailures = 3
+
+// checkHealth records the outcome of a git operation in w, a clone of repo, and once git has failed fatally
+// maxGitFailures times in a row, checks w for corruption, replacing it with a fresh clone of origin if git finds any.
+// Failures to reach origin, and errors git doesn't consider fatal, like merge conflicts, don't count either way.
+func checkHealth(repo *repo, w *workdir, what string, err error) {
+	if err == nil {
+		atomic.StoreInt32(&w.fatalErrors, 0)
+		return
+	}
+	if !strings.Contains(err.Error(), "fatal:") || gitPullError(err).Kind == PullNetwork {
+		return
+	}
+	if atomic.AddInt32(&w.fatalErrors, 1) < maxGitFailures {
+		return
+	}
+	atomic.StoreInt32(&w.fatalErrors, 0)
+	err = w.Fsck()
+	if err == nil {
+		glog.Warningf("git keeps failing in %s's %s, but it isn't corrupt", repo.name, what)
+		return
+	}
+	glog.Errorf("%s's %s in %s is corrupt, recloning: %s", repo.name, what, w.dir, err)
+	if err := repo.Reclone(w); err != nil {
+		glog.Errorf("error recloning %s's %s: %s", repo.name, what, err)
+		return
+	}
+	glog.Infof("recloned %s's %s into %s", repo.name, what, w.dir)
+}
+
+// Spin up a background goroutine to periodically squash repo's history down to -max_history_depth commits
+// until m shuts down. Since squashing pulls and pushes, it waits its turn among pulls,
+// and it's put off while any run has a branch off master.
+func compactHistory(m *Manager, repo *repo) {
+	if *maxHistoryDepth <= 0 {
+		return
+	}
+	m.goBackground(func() {
+		for {
+			select {
+			case <-time.After(settings().pullFrequency):
+			case <-m.stopping:
+				return
+			}
+			release, ok := m.pullSlot()
+			if !ok {
+				return
 			}
-			stopTime = make(chan time.Time, 1)
-			for _, entry := range entries {
-				go executeEntry(entry, repo, now, stopTime)
+			if !repo.history.TryLock() {
+				release()
+				glog.V(1).Infof("not squashing history for %s while jobs are running", repo.name)
+				continue
 			}
+			if err := repo.master.Squash(*maxHistoryDepth); err != nil {
+				glog.Errorf("error squashing history for %s: %s", repo.name, err)
+			}
+			repo.history.Unlock()
+			release()
 		}
+	})
+}
+
+// heartbeatFile is the path in a repo of the file that -heartbeat commits the time to,
+// and heartbeatSubject the message it commits it with.
+const (
+	heartbeatFile    = ".crony/heartbeat"
+	heartbeatSubject = "crony: heartbeat"
+)
+
+// Spin up a background goroutine to commit a heartbeat to repo every -heartbeat until m shuts down.
+// Simulated runs don't beat.
+func heartbeat(m *Manager, repo *repo) {
+	if *heartbeatInterval <= 0 || m.DryRun {
+		return
 	}
+	m.goBackground(func() {
+		for {
+			select {
+			case <-time.After(*heartbeatInterval):
+			case <-m.stopping:
+				return
+			}
+			m.mu.Lock()
+			if m.stopped {
+				m.mu.Unlock()
+				return
+			}
+			// Keep the repo from being closed under the heartbeat on shutdown.
+			m.running.Add(1)
+			m.mu.Unlock()
+			if err := commitHeartbeat(repo, time.Now()); err != nil {
+				glog.Errorf("error committing heartbeat to %s: %s", repo.name, err)
+			}
+			m.running.Done()
+		}
+	})
 }
 
-// Periodically execute a single crontab entry,
-// When a time is sent over the stopTime chan, stop execution at that time and return.
-func executeEntry(entry crontab.Entry, repo *repo, now time.Time, stopTime chan time.Time) {
+// commitHeartbeat writes now to heartbeatFile on a branch of repo, then merges it into master and pushes it,
+// just as a job's changes are.
+func commitHeartbeat(repo *repo, now time.Time) error {
+	repo.history.RLock()
+	defer repo.history.RUnlock()
+	w, err := repo.Branch()
+	checkHealth(repo, repo.master, "master", err)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	file := path.Join(w.dir, heartbeatFile)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(now.UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := w.Commit(heartbeatSubject, commitMode{paths: []string{heartbeatFile}}, time.Time{}); err != nil {
+		return err
+	}
+	if err := repo.master.Merge(w); err != nil {
+		return err
+	}
+	upstream, err := repo.master.Upstream()
+	if err != nil {
+		glog.Warningf("couldn't determine origin's head for %s: %s", repo.name, err)
+	}
+	if err := repo.master.Push(); err != nil {
+		if errors.Is(err, errPushNotAllowed) {
+			return err
+		}
+		if err := recoverHistory(repo, upstream); err != nil {
+			glog.Errorf("error recovering local history for %s: %s", repo.name, err)
+		}
+		return err
+	}
+	glog.V(1).Infof("committed heartbeat to %s", repo.name)
+	return nil
+}
+
+// Handle the incoming stream of parsed crontabs,
+// keeping a scheduler running the current crontab's jobs until m shuts down.
+// If -precondition is set, jobs are only scheduled once it passes,
+// and no crontab is applied until those of the repos named in after have been.
+func executeCrontab(m *Manager, repo *repo, queue *crontabQueue, after []string) {
+	for _, name := range after {
+		select {
+		case <-m.loadedChan(name):
+			continue
+		default:
+		}
+		glog.Infof("waiting for %s's crontab to load before starting %s", name, repo.name)
+		select {
+		case <-m.loadedChan(name):
+		case <-m.stopping:
+			return
+		}
+	}
+	var scheduler *crontab.Scheduler
+	var previous, scheduled []job
+	var retry <-chan time.Time
+	var backoff time.Duration
+	schedule := func() {
+		if err := checkPrecondition(m, repo); err != nil {
+			if scheduler != nil {
+				scheduler.Stop()
+				scheduler = nil
+			}
+			backoff *= 2
+			if backoff < preconditionMinBackoff {
+				backoff = preconditionMinBackoff
+			}
+			if max := settings().pullFrequency; backoff > max {
+				backoff = max
+			}
+			glog.Warningf("precondition failed for %s, not scheduling its jobs; retrying in %s: %s", repo.name, backoff, err)
+			retry = m.Clock.After(backoff)
+			return
+		}
+		retry = nil
+		backoff = 0
+		// Hand off from the previous crontab's scheduler to this one's as of the same instant,
+		// so that no run is missed or repeated.
+		now := m.Clock.Now()
+		if scheduler != nil {
+			scheduler.StopAt(now)
+		}
+		scheduler = newScheduler(m, repo, scheduled, previous)
+		scheduler.StartAt(now)
+		previous = scheduled
+	}
 	for {
-		next := entry.Schedule.Next(now)
 		select {
-		case <-time.After(next.Sub(time.Now())):
-			start := next
-			executeCommand(entry.Command, repo)
-			now = time.Now()
-			next = entry.Schedule.Next(next)
-			if !now.Before(next) {
-				glog.Errorf("command overran after %s: %s", now.Sub(start), entry.Command)
-				next = entry.Schedule.Next(now)
-			}
-		case t := <-stopTime:
-			stopTime <- t
-			if !t.Before(next) {
-				executeCommand(entry.Command, repo)
+		case entries := <-queue.updates:
+			var candidates []job
+			var rejected []RejectedEntry
+			for i, entry := range entries {
+				if strings.TrimSpace(entry.Command) == "" {
+					glog.Warningf("not scheduling entry without a command in %s", repo.name)
+					rejected = append(rejected, RejectedEntry{Command: entry.Command, Reason: "no command"})
+					continue
+				}
+				if duplicateEntry(entries, i) {
+					if *dedupEntries {
+						glog.Warningf("not scheduling duplicate entry for %s in %s", entry.Command, repo.name)
+						rejected = append(rejected, RejectedEntry{Command: entry.Command, Reason: "duplicate entry"})
+						continue
+					}
+					glog.Warningf("%s is scheduled by more than one identical entry in %s, so each time it's due, "+
+						"it runs once for each of them; pass -dedup_entries to only schedule it once", entry.Command, repo.name)
+				}
+				j, err := newJob(entry)
+				if err != nil {
+					glog.Errorf("not scheduling %s in %s: %s", entry.Command, repo.name, err)
+					rejected = append(rejected, RejectedEntry{Command: entry.Command, Reason: err.Error()})
+					continue
+				}
+				candidates = append(candidates, j)
+			}
+			errs := checkDependencies(candidates)
+			scheduled = nil
+			for i, j := range candidates {
+				if err, ok := errs[i]; ok {
+					glog.Errorf("not scheduling %s in %s: %s", j.Command, repo.name, err)
+					rejected = append(rejected, RejectedEntry{Command: j.Command, Reason: err.Error()})
+					continue
+				}
+				scheduled = append(scheduled, j)
+			}
+			glog.Infof("loaded crontab for %s: %d entries parsed, %d rejected, %d scheduled",
+				repo.name, len(entries), len(rejected), len(scheduled))
+			m.setJobs(repo.name, len(entries), scheduled, rejected)
+			backoff = 0
+			schedule()
+			queue.applied()
+			m.markLoaded(repo.name)
+		case <-retry:
+			schedule()
+		case <-m.stopping:
+			if scheduler != nil {
+				scheduler.Stop()
 			}
 			return
 		}
 	}
 }
 
-// Execute a single run of a single crontab entry.
-// Creates a new branch and workdir off of repo, then executes the given command in that workdir.
-// Commits and attempts to push the changes upstream.
-func executeCommand(command string, repo *repo) {
+// preconditionMinBackoff is how long to wait before first retrying a failed -precondition.
+// Each retry waits twice as long as the last, up to -pull_frequency.
+const preconditionMinBackoff = 10 * time.Second
+
+// checkPrecondition runs -precondition, if it's set, in repo's crontab clone, returning an error if it fails.
+// It's terminated if it's still running after -pull_frequency.
+// The clone isn't pulled while it runs, so that it never sees the clone partway through a pull.
+func checkPrecondition(m *Manager, repo *repo) error {
+	if *precondition == "" {
+		return nil
+	}
+	repo.crontab.mu.Lock()
+	defer repo.crontab.mu.Unlock()
+	cmd := exec.Command("/bin/bash", "-c", *precondition)
+	cmd.Dir = repo.crontab.dir
+	out, err := runCommand(cmd, settings().pullFrequency, m.terminating)
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runShutdownCommand runs -on_shutdown, if it's set, in repo's master, terminating it after -on_shutdown_timeout.
+func runShutdownCommand(repo *repo) error {
+	if *onShutdown == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/bash", "-c", *onShutdown)
+	cmd.Dir = repo.master.dir
+	cmd.Env = append(os.Environ(), "CRONY_REPO="+repo.name)
+	out, err := runCommand(cmd, *onShutdownTimeout, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// newScheduler returns a scheduler that runs jobs in repo by way of m,
+// also running those with run_on_start, and @since_success jobs that are due, as soon as it starts,
+// unless they were already scheduled in previous.
+func newScheduler(m *Manager, repo *repo, jobs, previous []job) *crontab.Scheduler {
+	s := &crontab.Scheduler{
+		Clock:           m.Clock,
+		RecheckInterval: m.RecheckInterval,
+		LastSuccess: func(entry crontab.Entry) time.Time {
+			return m.lastSuccess(repo.name, entry.Command)
+		},
+		OnError: func(entry crontab.Entry, err error) {
+			if jump, ok := err.(crontab.ClockJumpError); ok {
+				glog.Warningf("clock jumped by %s while waiting to run, rescheduling: %s", jump.Jump, entry.Command)
+			} else if err == crontab.ErrScheduleEnded {
+				glog.Warningf("schedule never fires again: %s", entry.Command)
+			} else {
+				glog.Errorf("command %s: %s", err, entry.Command)
+			}
+		},
+	}
+	now := m.Clock.Now()
+	for _, j := range jobs {
+		j := j
+		every := j.Schedule.SinceSuccess()
+		due := every > 0 && !m.lastSuccess(repo.name, j.Command).Add(every).After(now)
+		runNow := (j.runOnStart || due) && !containsEntry(previous, j.Entry)
+		// The scheduler calls run once at a time, so the first call, the one as soon as it starts, can be told apart.
+		catchingUp := runNow
+		run := func(scheduled time.Time, _ <-chan struct{}) error {
+			trigger := triggerSchedule
+			if catchingUp {
+				trigger = triggerCatchup
+				catchingUp = false
+			}
+			m.runJob(repo, j, scheduled, trigger)
+			return nil
+		}
+		s.AddTimed(j.Entry, runNow, run)
+	}
+	return s
+}
+
+// duplicateEntry determines whether any entry before the ith in entries is Equal to it.
+func duplicateEntry(entries []crontab.Entry, i int) bool {
+	for _, entry := range entries[:i] {
+		if entry.Equal(entries[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsEntry determines whether any of jobs is for entry.
+func containsEntry(jobs []job, entry crontab.Entry) bool {
+	for _, j := range jobs {
+		if reflect.DeepEqual(j.Entry, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// handOver lets the user and group of credential change anything in a workdir's working tree in dir.
+// Everything under dir, other than .git, is given to them, not following symlinks,
+// while dir itself stays crony's, since git won't work in a repository owned by another user,
+// but is given to their group, with write permission for it.
+func handOver(dir string, credential *syscall.Credential) error {
+	if err := os.Chown(dir, os.Getuid(), int(credential.Gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, os.FileMode(workdirMode)|0070); err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if info.IsDir() && path == filepath.Join(dir, ".git") {
+			return filepath.SkipDir
+		}
+		return os.Lchown(path, int(credential.Uid), int(credential.Gid))
+	})
+}
+
+// orphanWaitDelay is how long runCommand waits, once a command exits, for processes it left in the background
+// to close its output, before killing them.
+const orphanWaitDelay = time.Second
+
+// Run cmd in its own process group, along with any other process attributes it already has, returning its combined output.
+// If it's still running after timeout (if positive), or once terminate is closed,
+// send SIGTERM to its process group, then SIGKILL if it hasn't exited within -kill_grace_period.
+// Once it exits, any processes it left in its process group are killed too.
+func runCommand(cmd *exec.Cmd, timeout time.Duration, terminate <-chan struct{}) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	// Background processes the command leaves behind may hold its output open; don't wait on them for long.
+	cmd.WaitDelay = orphanWaitDelay
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if errors.Is(err, exec.ErrWaitDelay) {
+			glog.Warningf("left processes running in the background: %s", strings.Join(cmd.Args, " "))
+			err = nil
+		}
+		// Kill whatever's left of its process group, so that nothing the command started outlives it.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		done <- err
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+	var reason string
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-timedOut:
+		reason = fmt.Sprintf("timed out after %s", timeout)
+	case <-terminate:
+		reason = "terminated on shutdown"
+	}
+
+	glog.Warningf("%s, sending SIGTERM: %s", reason, strings.Join(cmd.Args, " "))
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	var err error
+	grace := settings().killGracePeriod
+	select {
+	case err = <-done:
+	case <-time.After(grace):
+		glog.Warningf("still running after %s, sending SIGKILL: %s", grace, strings.Join(cmd.Args, " "))
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		err = <-done
+	}
+	return out.Bytes(), fmt.Errorf("%s: %v", reason, err)
+}
+
+// runSubject returns the subject line of the commit for a run of command that exited with exitCode, as set by -commit_subject.
+func runSubject(command string, exitCode int) string {
+	// Before slugifying it, which could keep a secret from matching -redact.
+	command = redact(command)
+	subject := strings.NewReplacer(
+		"{command}", command,
+		"{slug}", slugify(command),
+		"{exit}", strconv.Itoa(exitCode),
+	).Replace(*commitSubject)
+	// A newline in the command would spill it into the body.
+	return strings.SplitN(redact(subject), "\n", 2)[0]
+}
+
+// Execute a single run of a single job, scheduled for the given time, and caused by trigger.
+// Creates a new branch and workdir off of repo, then executes the job's command in that workdir,
+// terminating it if it runs past its timeout or once terminate is closed.
+// Commits and attempts to push the changes upstream, publishing events to bus along the way.
+// The result's error is set if the command couldn't be run or failed;
+// failing to commit or push its changes is only logged.
+func executeCommand(bus *EventBus, j job, repo *repo, scheduled time.Time, trigger trigger, terminate <-chan struct{}) (result RunResult) {
+	command := j.Command
 	glog.Infof("running: %s", command)
+	result = RunResult{Command: command, Start: time.Now()}
+	defer func() {
+		result.End = time.Now()
+		glog.Infof("finished in %s with outcome=%s changed=%t: %s",
+			result.End.Sub(result.Start), result.Outcome(), result.Changed, command)
+		bus.publish(Event{Type: JobCompleted, Repo: repo.name, Command: command, Err: result.Err, Result: &result})
+	}()
+	if j.timeout = j.runTimeout(result.Start); j.timeout < 0 {
+		result.Err = errors.New("no time to run before the next scheduled run")
+		glog.Errorf("%s: %s", result.Err, command)
+		return
+	}
+
+	repo.history.RLock()
+	defer repo.history.RUnlock()
 	w, err := repo.Branch()
+	checkHealth(repo, repo.master, "master", err)
 	if err != nil {
 		glog.Errorf("unable to create branch: %s", err)
+		result.Err = err
 		return
 	}
 	defer w.Close()
+	glog.V(1).Infof("using branch %s in %s for: %s", w.branch, w.dir, command)
+	if *keepFailedBranches {
+		// Runs before w is closed, deleting its branch.
+		defer func() {
+			if result.Err == nil {
+				return
+			}
+			name := fmt.Sprintf("crony/failed/%s/%s", slugify(redact(command)), result.Start.UTC().Format("20060102T150405Z"))
+			if err := w.Keep(name); err != nil {
+				glog.Errorf("unable to keep failed branch as %s: %s", name, err)
+				return
+			}
+			glog.Infof("kept failed branch as %s: %s", name, command)
+			result.KeptBranch = name
+		}()
+	}
+
+	bus.publish(Event{Type: JobStarted, Repo: repo.name, Command: command})
+	if j.credential != nil {
+		// git checks files out as crony's user, so hand them over to the user running the command.
+		if err := handOver(w.dir, j.credential); err != nil {
+			glog.Errorf("unable to give %s to %s: %s", w.dir, j.User, err)
+			result.Err = err
+			return
+		}
+	}
+	ctx, cancel := terminateContext(terminate)
+	out, code, runErr := repo.Executor().Execute(ctx, j, w.dir, []string{"CRONY_REPO=" + repo.name})
+	cancel()
+	var status string
+	if runErr != nil && code > 0 && j.succeeded(code) {
+		status = fmt.Sprintf("exit status %d", code)
+		runErr = nil
+	}
+	if runErr != nil && code == commandNotFoundExitCode {
+		glog.Errorf("command not found; is the crontab misconfigured? %s", command)
+		result.CommandNotFound = true
+	}
+	// Whether the command left changes it wasn't expected to, which aren't committed.
+	unclean := false
+	if j.requireCleanAfter && runErr == nil {
+		changed, err := w.ChangedFiles()
+		if err != nil {
+			runErr = fmt.Errorf("couldn't list the files the command changed: %s", err)
+		} else if unexpected := j.unexpectedChanges(changed); len(unexpected) > 0 {
+			runErr = fmt.Errorf("changed files it isn't expected to produce: %s", strings.Join(unexpected, ", "))
+		}
+		unclean = runErr != nil
+	}
+	bus.publish(Event{Type: JobFinished, Repo: repo.name, Command: command, Output: out, Err: runErr})
+	result.Err = runErr
+	if *outputLogDir != "" {
+		if err := appendOutputLog(repo, command, result.Start, code, out); err != nil {
+			glog.Errorf("unable to append output to its log in -output_log_dir: %s", err)
+		}
+	}
 
-	cmd := exec.Command("/bin/bash", "-c", command)
-	cmd.Dir = w.dir
-	out, err := cmd.CombinedOutput()
+	if j.outputFile != "" {
+		outputPath := path.Join(w.dir, j.outputFile)
+		if err := os.MkdirAll(path.Dir(outputPath), 0755); err != nil {
+			glog.Errorf("unable to create directory for %s: %s", j.outputFile, err)
+		} else if err := ioutil.WriteFile(outputPath, []byte(redact(string(out))), 0644); err != nil {
+			glog.Errorf("unable to write output to %s: %s", j.outputFile, err)
+		}
+		if j.skipUnchangedOutput && runErr == nil {
+			unchanged, err := w.Unchanged(j.outputFile)
+			if err != nil {
+				glog.Errorf("couldn't determine whether %s changed: %s", j.outputFile, err)
+			} else if unchanged {
+				glog.Infof("output unchanged, not committing: %s", command)
+				return
+			}
+		}
+	}
 
 	ts := time.Now().Format(time.UnixDate)
-	commitMsg := fmt.Sprintf("$ %s\n%s", command, string(out))
-	if err != nil {
-		commitMsg += "\n" + err.Error()
-		if err := ioutil.WriteFile(path.Join(w.dir, ".fail"), []byte(ts), 0700); err != nil {
+	commitMsg := fmt.Sprintf("%s\n\n$ %s\n%s", runSubject(command, code), redact(command), redact(string(out)))
+	if j.outputNotes {
+		commitMsg = fmt.Sprintf("%s\n\n$ %s\n", runSubject(command, code), redact(command))
+	}
+	if j.summarizeChanges && len(bytes.TrimSpace(out)) == 0 {
+		// Without any output, say what the command did instead.
+		if changed, err := w.ChangedFiles(); err != nil {
+			glog.Errorf("couldn't list the files the command changed: %s", err)
+		} else if len(changed) > 0 {
+			commitMsg += "\nchanged:\n  " + strings.Join(changed, "\n  ") + "\n"
+		}
+	}
+	if status != "" {
+		commitMsg += "\n" + status
+	}
+	if runErr != nil {
+		commitMsg += "\n" + redact(runErr.Error())
+		failPath := path.Join(w.dir, ".fail")
+		if err := ioutil.WriteFile(failPath, []byte(ts), os.FileMode(failFileMode)); err != nil {
 			glog.Errorf("unable to write to .fail: %s", err)
+		} else if err := os.Chmod(failPath, os.FileMode(failFileMode)); err != nil {
+			glog.Errorf("unable to set mode of .fail: %s", err)
 		}
 	}
+	commitMsg += "\n\n" + runTrailers(j, scheduled, trigger, result.Start, code, runErr)
 
-	hasChanges, err := w.HasChanges()
+	if len(j.produces) > 0 && runErr == nil {
+		changed, err := w.ChangedFiles()
+		if err != nil {
+			glog.Errorf("couldn't list files changed by %s: %s", command, err)
+		} else if !j.producedAny(changed) {
+			glog.Warningf("none of the files it's expected to produce (%s) changed: %s",
+				strings.Join(j.produces, ","), command)
+		}
+	}
+
+	// Files crony writes are committed whatever the job's commit mode.
+	mode := j.commitMode
+	if unclean {
+		glog.Errorf("not committing the command's changes, since it changed files it isn't expected to produce: %s", command)
+		mode = commitMode{paths: []string{".fail"}}
+	}
+	if j.outputFile != "" {
+		mode.include = append(mode.include, j.outputFile)
+	}
+	if runErr != nil {
+		mode.include = append(mode.include, ".fail")
+	}
+	hasChanges, err := w.HasChanges(mode)
 	if err != nil {
 		glog.Errorf("couldn't determine whether %s has changes: %s", w.branch, err)
 		return
@@ -139,37 +1141,196 @@ func executeCommand(command string, repo *repo) {
 		return
 	}
 
-	if err := w.Commit(commitMsg); err != nil {
+	if err := w.Commit(commitMsg, mode, j.commitTime(scheduled)); err != nil {
 		glog.Errorf("unable to commit: %s", err)
 		return
 	}
+	result.Changed = true
 
 	if err := repo.master.Merge(w); err != nil {
 		glog.Errorf("unable to merge temp branch into local master: %s", err)
+		bus.publish(Event{Type: PushFailed, Repo: repo.name, Command: command, Err: err})
 		return
 	}
+	if j.outputNotes && len(out) > 0 {
+		// Merging rebased the job's commit onto master, so it's no longer the one committed above.
+		if commit, err := w.revParse("HEAD"); err != nil {
+			glog.Errorf("couldn't find the commit to attach output to: %s", err)
+		} else if err := repo.master.AddNote(commit, redact(string(out))); err != nil {
+			glog.Errorf("unable to attach output as a note: %s", err)
+		}
+	}
 
+	upstream, err := repo.master.Upstream()
+	if err != nil {
+		glog.Warningf("couldn't determine origin's head for %s: %s", repo.name, err)
+	}
 	if err := repo.master.Push(); err != nil {
 		glog.Errorf("unable to push master: %s", err)
-		glog.Errorf("trying to overwrite local head with origin for future commits to be rebased on...")
-		if err := repo.master.FetchHead(); err != nil {
-			glog.Errorf("error overwriting local head with origin: %s", err)
+		bus.publish(Event{Type: PushFailed, Repo: repo.name, Command: command, Err: err})
+		if errors.Is(err, errPushNotAllowed) {
+			// Nothing's wrong with local history; keep the commit in it.
+			return
+		}
+		if err := recoverHistory(repo, upstream); err != nil {
+			glog.Errorf("error recovering local history for %s: %s", repo.name, err)
+		}
+		return
+	}
+
+	if j.outputNotes {
+		if err := repo.master.PushNotes(); err != nil {
+			glog.Errorf("unable to push notes: %s", err)
 		}
 	}
 
+	bus.publish(Event{Type: CommitPushed, Repo: repo.name, Command: command})
 	glog.Infof("committed changes: %s", command)
+	return
 }
 
 func main() {
 	flag.Parse()
-	for _, url := range flag.Args() {
-		r, err := NewClone(url, url)
+	repos, err := loadConfig()
+	if err != nil {
+		glog.Fatalf("error loading -config: %s", err)
+	}
+	publishSettings()
+	if *auditRepo {
+		if flag.NArg() != 1 {
+			glog.Fatalf("-audit takes the directory of a clone of the repo to audit")
+		}
+		records, err := readAudit(execGit{}, flag.Arg(0))
 		if err != nil {
-			glog.Fatalf("error cloning %s: %s", url, err)
+			glog.Fatalf("error reading runs from %s: %s", flag.Arg(0), err)
 		}
-		defer r.Close()
-		crontabUpdates := watchCrontab(r)
-		go executeCrontab(r, crontabUpdates)
+		if err := writeAudit(records, *auditFormat, os.Stdout); err != nil {
+			glog.Fatalf("error writing runs: %s", err)
+		}
+		return
 	}
-	select {}
+	if *diffCrontabs {
+		if flag.NArg() != 2 {
+			glog.Fatalf("-diff takes the old and new crontab files to compare")
+		}
+		changes, err := diffCrontabFiles(flag.Arg(0), flag.Arg(1), time.Now(), os.Stdout)
+		if err != nil {
+			glog.Fatalf("error comparing crontabs: %s", err)
+		}
+		if changes > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *explainSchedule {
+		if flag.NArg() < 1 || flag.NArg() > 2 {
+			glog.Fatalf("-explain takes a schedule, and optionally the time at which to explain it")
+		}
+		t := time.Now()
+		if flag.NArg() == 2 {
+			var err error
+			if t, err = time.Parse(time.RFC3339, flag.Arg(1)); err != nil {
+				glog.Fatalf("invalid time to explain: %s", err)
+			}
+		}
+		fires, err := explainScheduleAt(flag.Arg(0), t, os.Stdout)
+		if err != nil {
+			glog.Fatalf("error explaining schedule: %s", err)
+		}
+		if !fires {
+			os.Exit(1)
+		}
+		return
+	}
+	if _, err := exec.LookPath(*gitBinary); err != nil {
+		glog.Fatalf("invalid -git_binary: %s", err)
+	}
+	if *gitConfig != "" {
+		if _, err := os.Stat(*gitConfig); err != nil {
+			glog.Fatalf("invalid -git_config: %s", err)
+		}
+	}
+	m := NewManager(settings().maxConcurrentJobs)
+	m.SetMaxConcurrentPulls(settings().maxConcurrentPulls)
+	if *simulateSpeed > 0 {
+		start := time.Now()
+		if *simulateStart != "" {
+			var err error
+			if start, err = time.Parse(time.RFC3339, *simulateStart); err != nil {
+				glog.Fatalf("invalid -simulate_start: %s", err)
+			}
+		}
+		glog.Infof("simulating from %s at %gx speed; jobs will be logged instead of run", start, *simulateSpeed)
+		m.Clock = newFastClock(start, *simulateSpeed)
+		// Check the simulated clock about once a real second, rather than once a simulated minute.
+		m.RecheckInterval = time.Duration(*simulateSpeed * float64(time.Second))
+		m.DryRun = true
+	}
+	if *stateFile != "" {
+		if err := m.LoadState(*stateFile); err != nil {
+			glog.Fatalf("error loading -state_file: %s", err)
+		}
+	}
+	if *startPaused {
+		m.Pause("")
+	}
+	serveHTTP(m)
+	// Each argument is a repo's URL, optionally followed by comma-separated URLs of its mirrors.
+	for _, arg := range flag.Args() {
+		urls := strings.Split(arg, ",")
+		repos = append(repos, RepoConfig{Origin: urls[0], Mirrors: urls[1:]})
+	}
+	for _, c := range repos {
+		if err := m.Add(c); err != nil {
+			glog.Fatalf("error adding %s: %s", c.name(), err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	idle := watchIdle(m, *exitWhenIdle)
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				glog.Infof("got %s, reloading -config", sig)
+				if err := reloadConfig(m); err != nil {
+					glog.Errorf("error reloading -config: %s", err)
+				}
+				continue
+			}
+			glog.Infof("got %s, shutting down...", sig)
+		case <-idle:
+			glog.Infof("no jobs running or due within %s, shutting down...", *exitWhenIdle)
+		}
+		break
+	}
+	m.Shutdown()
+	glog.Flush()
+}
+
+// How often watchIdle checks whether the manager is idle.
+const idleCheckInterval = time.Second
+
+// watchIdle returns a channel that's closed once m has no jobs running or due within horizon,
+// or nil, which is never closed, if horizon isn't positive.
+// m must be idle on two checks in a row, so that a job the scheduler has only just fired isn't missed.
+func watchIdle(m *Manager, horizon time.Duration) <-chan struct{} {
+	if horizon <= 0 {
+		return nil
+	}
+	idle := make(chan struct{})
+	go func() {
+		wasIdle := false
+		for {
+			<-time.After(idleCheckInterval)
+			isIdle := m.Idle(horizon)
+			if isIdle && wasIdle {
+				close(idle)
+				return
+			}
+			wasIdle = isIdle
+		}
+	}()
+	return idle
 }
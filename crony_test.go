@@ -0,0 +1,872 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Tests of crony as a whole run the test binary again as crony.
+	if os.Getenv("CRONY_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	// Tests point TMPDIR at directories of their own, so glog can't keep its files there.
+	flag.Set("logtostderr", "true")
+	os.Exit(m.Run())
+}
+
+// setFlag sets the named flag to value for the rest of the test, publishing it if it's reloadable.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	t.Cleanup(func() {
+		flag.Set(name, old)
+		publishSettings()
+	})
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	publishSettings()
+}
+
+func TestPullSkippedWhileOriginUnchanged(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	git := &fakeBackend{}
+	r := newTestRepo(t, git, origin)
+	m := NewManager(0)
+	queue := newCrontabQueue()
+	pulls := func() int { return len(git.called("Fetch", "Pull")) }
+
+	before := pulls()
+	if err := pullCrontab(m, r, queue); err != nil {
+		t.Fatal(err)
+	}
+	if err := pullMaster(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := pulls() - before; got != 0 {
+		t.Errorf("pulled %d times while origin was unchanged, want 0", got)
+	}
+	if entries := <-queue.updates; len(entries) != 1 {
+		t.Errorf("read %d entries without pulling, want 1", len(entries))
+	}
+
+	pushToOrigin(t, origin, map[string]string{"crontab": "* * * * * true\n0 * * * * date\n"}, "add an entry")
+	before = pulls()
+	if err := pullCrontab(m, r, queue); err != nil {
+		t.Fatal(err)
+	}
+	if err := pullMaster(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := pulls() - before; got != 2 {
+		t.Errorf("pulled %d times once origin changed, want 2", got)
+	}
+	if entries := <-queue.updates; len(entries) != 2 {
+		t.Errorf("read %d entries after pulling, want 2", len(entries))
+	}
+}
+
+// commitLocally commits files, by path, to repo's master without pushing them.
+func commitLocally(t *testing.T, r *repo, files map[string]string, msg string) {
+	t.Helper()
+	w, err := r.Branch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for name, contents := range files {
+		writeFile(t, filepath.Join(w.dir, name), contents)
+	}
+	if err := w.Commit(msg, commitMode{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.master.Merge(w); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullModes(t *testing.T) {
+	for _, test := range []struct {
+		mode pullMode
+		// Whether pulling diverged history should succeed, and if so, whether it keeps the local commit.
+		ok, keepsLocal bool
+	}{
+		{pullRebase, true, true},
+		{pullFastForwardOnly, false, true},
+		{pullReset, true, false},
+	} {
+		t.Run(string(test.mode), func(t *testing.T) {
+			setUpGit(t)
+			setFlag(t, "check_remote_head", "false")
+			origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+			r := newTestRepo(t, execGit{}, origin)
+			r.pullMode = test.mode
+			commitLocally(t, r, map[string]string{"local.txt": "local\n"}, "local change")
+			pushToOrigin(t, origin, map[string]string{"remote.txt": "remote\n"}, "remote change")
+			local := runGit(t, r.master.dir, "rev-parse", "HEAD")
+
+			err := pullMaster(r)
+			if ok := err == nil; ok != test.ok {
+				t.Fatalf("pulling diverged history returned %v, want success=%t", err, test.ok)
+			}
+			if !test.ok {
+				if !strings.Contains(err.Error(), "has history diverged") {
+					t.Errorf("pulling diverged history returned %q, want it to say so", err)
+				}
+				if head := runGit(t, r.master.dir, "rev-parse", "HEAD"); head != local {
+					t.Errorf("master moved from %s to %s after failing to pull", local, head)
+				}
+				return
+			}
+			gitDir := filepath.Join(r.master.dir, ".git")
+			if originFile(t, gitDir, "HEAD", "remote.txt") == "" {
+				t.Error("origin's commit wasn't pulled")
+			}
+			if keeps := originFile(t, gitDir, "HEAD", "local.txt") != ""; keeps != test.keepsLocal {
+				t.Errorf("after pulling, master has the local commit: %t, want %t", keeps, test.keepsLocal)
+			}
+		})
+	}
+}
+
+func TestHistoryRewriteModes(t *testing.T) {
+	for _, test := range []struct {
+		mode rewriteMode
+		// What pulling rewritten history should return, if an error,
+		// and whether master should then have origin's rewritten history and the unpushed commit that still applies.
+		err                 string
+		rewritten, keepsNew bool
+	}{
+		{rewriteReset, "", true, false},
+		{rewritePreserve, "dropped 1 of 2 unpushed commits", true, true},
+		{rewriteAbort, errHistoryRewritten.Error(), false, true},
+	} {
+		t.Run(string(test.mode), func(t *testing.T) {
+			setUpGit(t)
+			setFlag(t, "check_remote_head", "false")
+			origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+			r := newTestRepo(t, execGit{}, origin)
+			r.pullMode = pullRebase
+			r.rewriteMode = test.mode
+			// One unpushed commit conflicts with the rewritten history, so that it can't be rebased onto it.
+			commitLocally(t, r, map[string]string{"crontab": "* * * * * false\n"}, "unpushed conflicting change")
+			commitLocally(t, r, map[string]string{"local.txt": "local\n"}, "unpushed change")
+
+			// Replace origin's history with an unrelated one.
+			work := filepath.Join(t.TempDir(), "work")
+			runGit(t, "", "clone", "-q", origin, work)
+			runGit(t, work, "checkout", "-q", "--orphan", "rewritten")
+			writeFile(t, filepath.Join(work, "crontab"), "0 * * * * ./rewritten\n")
+			runGit(t, work, "add", "-A")
+			runGit(t, work, "commit", "-q", "-m", "rewritten history")
+			runGit(t, work, "push", "-q", "-f", "origin", "rewritten:master")
+
+			err := pullMaster(r)
+			if test.err == "" && err != nil {
+				t.Errorf("pulling rewritten history failed: %s", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("pulling rewritten history returned %v, want %q", err, test.err)
+			}
+			gitDir := filepath.Join(r.master.dir, ".git")
+			if rewritten := originFile(t, gitDir, "HEAD", "crontab") == "0 * * * * ./rewritten\n"; rewritten != test.rewritten {
+				t.Errorf("after pulling, master has origin's rewritten crontab: %t, want %t", rewritten, test.rewritten)
+			}
+			if keeps := originFile(t, gitDir, "HEAD", "local.txt") != ""; keeps != test.keepsNew {
+				t.Errorf("after pulling, master has the unpushed commit: %t, want %t", keeps, test.keepsNew)
+			}
+		})
+	}
+}
+
+func TestRunOnStart(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# crony: run_on_start\n0 * * * * ./hourly\n0 * * * * ./other\n"})
+	clock := &fakeClock{now: time.Date(2026, time.March, 1, 12, 30, 0, 0, time.UTC)}
+	executor := &recordingExecutor{}
+	newTestManager(t, execGit{}, executor, clock, origin)
+	ran := func() string {
+		var commands []string
+		for _, e := range executor.recorded() {
+			commands = append(commands, e.command)
+		}
+		return strings.Join(commands, " ")
+	}
+
+	eventually(t, "run_on_start entry didn't run on start", func() bool { return ran() == "./hourly" })
+	// Both entries are waiting for 13:00.
+	eventually(t, "entries aren't waiting for their next runs", func() bool { return clock.waiting() == 2 })
+	if got := ran(); got != "./hourly" {
+		t.Errorf("ran %s before 13:00, want only ./hourly, on start", got)
+	}
+	clock.set(time.Date(2026, time.March, 1, 13, 0, 0, 0, time.UTC))
+	eventually(t, "entries didn't run at 13:00", func() bool { return len(executor.recorded()) == 3 })
+}
+
+func TestSuccessExitCodes(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	bus := &EventBus{}
+	var finished Event
+	bus.Subscribe(func(e Event) {
+		if e.Type == JobFinished {
+			finished = e
+		}
+	})
+
+	j := testJob(t, "# crony: success_exit_codes=0,1\n* * * * * echo no match | tee grep.txt; exit 1")
+	executeCommand(bus, j, r, time.Now(), triggerSchedule, nil)
+	if finished.Err != nil {
+		t.Errorf("run exiting with 1 failed with %v, want success", finished.Err)
+	}
+	if originFile(t, origin, "master", ".fail") != "" {
+		t.Error("committed a .fail file for a run exiting with a success code")
+	}
+	msg := runGit(t, origin, "log", "-1", "--format=%B", "master")
+	if !strings.Contains(msg, "\nno match\n") || !strings.Contains(msg, "(exit 1)") {
+		t.Errorf("commit message %q doesn't have the run's output and exit code", msg)
+	}
+
+	j = testJob(t, "# crony: success_exit_codes=0,1\n* * * * * date > grep.txt; exit 2")
+	if executeCommand(bus, j, r, time.Now(), triggerSchedule, nil); finished.Err == nil {
+		t.Error("run exiting with 2 succeeded, though only 0 and 1 are success codes")
+	}
+	if originFile(t, origin, "master", ".fail") == "" {
+		t.Error("no .fail file committed for a run exiting with a code that isn't a success")
+	}
+}
+
+// modeBackend is a GitBackend that notes the modes of the .fail file and the workdir it's committed from.
+type modeBackend struct {
+	execGit
+	failMode, dirMode os.FileMode
+}
+
+func (b *modeBackend) Commit(dir, msg string) error {
+	if info, err := os.Stat(filepath.Join(dir, ".fail")); err == nil {
+		b.failMode = info.Mode().Perm()
+	}
+	if info, err := os.Stat(dir); err == nil {
+		b.dirMode = info.Mode().Perm()
+	}
+	return b.execGit.Commit(dir, msg)
+}
+
+func TestFileModes(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "workdir_mode", "0750")
+	setFlag(t, "fail_file_mode", "0600")
+	if info, err := os.Stat(tempDir()); err != nil {
+		t.Fatal(err)
+	} else if got := info.Mode().Perm(); got != 0750 {
+		t.Errorf("temporary directory's mode is %#o, want %#o", got, 0750)
+	}
+
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	git := &modeBackend{}
+	r := newTestRepo(t, git, origin)
+	executeCommand(&EventBus{}, testJob(t, "* * * * * false"), r, time.Now(), triggerSchedule, nil)
+	if git.failMode != 0600 {
+		t.Errorf(".fail file's mode is %#o, want %#o", git.failMode, 0600)
+	}
+	if git.dirMode != 0750 {
+		t.Errorf("workdir's mode is %#o, want %#o", git.dirMode, 0750)
+	}
+}
+
+func TestCommandNotFound(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+
+	for _, test := range []struct {
+		lines   string
+		outcome Outcome
+	}{
+		{"* * * * * no-such-command --flag", OutcomeCommandNotFound},
+		{"# crony: runner=exec\n* * * * * no-such-command --flag", OutcomeCommandNotFound},
+		{"* * * * * exit 1", OutcomeFailed},
+	} {
+		result := executeCommand(&EventBus{}, testJob(t, test.lines), r, time.Now(), triggerSchedule, nil)
+		if result.Err == nil {
+			t.Errorf("%q succeeded", test.lines)
+		}
+		if got := result.Outcome(); got != test.outcome {
+			t.Errorf("%q had outcome %s, want %s", test.lines, got, test.outcome)
+		}
+	}
+}
+
+func TestCrontabRef(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./prod\n"})
+	runGit(t, origin, "tag", "crony-prod", "master")
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./prod\n30 * * * * ./staged\n"}, "stage an entry")
+	r := newTestRepo(t, execGit{}, origin)
+	r.crontabRef = "crony-prod"
+	m := NewManager(0)
+	queue := newCrontabQueue()
+	read := func() []string {
+		t.Helper()
+		if err := pullCrontab(m, r, queue); err != nil {
+			t.Fatal(err)
+		}
+		var commands []string
+		for _, entry := range <-queue.updates {
+			commands = append(commands, entry.Command)
+		}
+		return commands
+	}
+
+	if got := strings.Join(read(), " "); got != "./prod" {
+		t.Errorf("read %s from the tag, want ./prod alone", got)
+	}
+	// Promote the staged entry by moving the tag.
+	runGit(t, origin, "tag", "-f", "crony-prod", "master")
+	if got := strings.Join(read(), " "); got != "./prod ./staged" {
+		t.Errorf("read %s after moving the tag, want ./prod ./staged", got)
+	}
+	// Jobs still commit to the branch.
+	if result := executeCommand(&EventBus{}, testJob(t, "* * * * * date > now.txt"), r, time.Now(), triggerSchedule, nil); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if originFile(t, origin, "master", "now.txt") == "" {
+		t.Error("the job's changes weren't pushed to master")
+	}
+}
+
+func TestRunCommandTermsBeforeKilling(t *testing.T) {
+	setFlag(t, "kill_grace_period", "10s")
+	// Waiting on sleep in the background lets bash run the trap as soon as the signal arrives.
+	cleanup := "trap 'echo cleaned up; exit 3' TERM; sleep 30 & wait"
+	start := time.Now()
+	out, err := runCommand(exec.Command("/bin/bash", "-c", cleanup), 500*time.Millisecond, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if string(out) != "cleaned up\n" {
+		t.Errorf("output was %q, want the trap's", out)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s, though the command exited on SIGTERM", elapsed)
+	}
+
+	terminate := make(chan struct{})
+	time.AfterFunc(500*time.Millisecond, func() { close(terminate) })
+	out, err = runCommand(exec.Command("/bin/bash", "-c", cleanup), 0, terminate)
+	if err == nil || !strings.Contains(err.Error(), "terminated on shutdown") {
+		t.Errorf("got error %v, want termination on shutdown", err)
+	}
+	if string(out) != "cleaned up\n" {
+		t.Errorf("output on shutdown was %q, want the trap's", out)
+	}
+
+	setFlag(t, "kill_grace_period", "500ms")
+	start = time.Now()
+	_, err = runCommand(exec.Command("/bin/bash", "-c", "trap '' TERM; sleep 30 & wait"), 100*time.Millisecond, nil)
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("got error %v, want the command killed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to kill a command ignoring SIGTERM, want about the grace period", elapsed)
+	}
+}
+
+func TestVerifyCrontab(t *testing.T) {
+	setUpGit(t)
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg isn't installed")
+	}
+	setFlag(t, "verify_crontab", "true")
+	t.Setenv("GNUPGHOME", t.TempDir())
+	t.Cleanup(func() { exec.Command("gpgconf", "--kill", "gpg-agent").Run() })
+	if out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "crony <crony@localhost>", "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Skipf("couldn't generate a key: %s\n%s", err, out)
+	}
+
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./unsigned\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	m := NewManager(0)
+	queue := newCrontabQueue()
+	pull := func() error {
+		err := pullCrontab(m, r, queue)
+		if pullErr, ok := err.(*PullError); err != nil && (!ok || pullErr.Kind != PullUntrusted) {
+			t.Fatal(err)
+		}
+		return err
+	}
+
+	if err := pull(); err == nil {
+		t.Error("trusted an unsigned crontab")
+	}
+
+	work := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "clone", "-q", origin, work)
+	writeFile(t, filepath.Join(work, "crontab"), "0 * * * * ./signed\n")
+	runGit(t, work, "commit", "-q", "-a", "-S", "-m", "sign the crontab")
+	runGit(t, work, "push", "-q")
+	if err := pull(); err != nil {
+		t.Errorf("didn't trust a signed crontab: %s", err)
+	} else if entries := <-queue.updates; len(entries) != 1 || entries[0].Command != "./signed" {
+		t.Errorf("read %v from the signed crontab, want ./signed", entries)
+	}
+
+	// A later unsigned change isn't trusted, even on top of a signed one.
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./tampered\n"}, "tamper with the crontab")
+	if err := pull(); err == nil {
+		t.Error("trusted an unsigned change to a signed crontab")
+	}
+	select {
+	case entries := <-queue.updates:
+		t.Errorf("queued %v from an untrusted crontab", entries)
+	default:
+	}
+}
+
+func TestPullCrontabWhileMasterIsStuck(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./hourly\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	m := NewManager(0)
+	queue := newCrontabQueue()
+
+	// Wedge master, as a merge or push that never finishes would.
+	r.master.mu.Lock()
+	defer r.master.mu.Unlock()
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./hourly\n0 0 * * * ./daily\n"}, "add an entry")
+	done := make(chan error, 1)
+	go func() { done <- pullCrontab(m, r, queue) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("pulling the crontab is stuck behind master")
+	}
+	if entries := <-queue.updates; len(entries) != 2 {
+		t.Errorf("read %d entries while master was stuck, want 2", len(entries))
+	}
+}
+
+// captureLogs returns what's logged to stderr while f runs.
+func captureLogs(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	logged := make(chan string)
+	go func() {
+		var buf strings.Builder
+		io.Copy(&buf, r)
+		logged <- buf.String()
+	}()
+	func() {
+		defer func() { os.Stderr = stderr }()
+		f()
+	}()
+	w.Close()
+	return <-logged
+}
+
+func TestProducesWarnsWhenNothingProduced(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	const warning = "none of the files it's expected to produce (reports/*.csv) changed"
+
+	for _, test := range []struct {
+		command string
+		warns   bool
+	}{
+		{"mkdir -p reports; date > reports/today.csv", false},
+		{"date > scratch.txt", true},
+	} {
+		j := testJob(t, "# crony: produces=reports/*.csv\n* * * * * "+test.command)
+		var result RunResult
+		logged := captureLogs(t, func() {
+			result = executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil)
+		})
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if warns := strings.Contains(logged, warning); warns != test.warns {
+			t.Errorf("%q warned that it produced nothing: %t, want %t", test.command, warns, test.warns)
+		}
+		if !result.Changed {
+			t.Errorf("%q's changes weren't committed", test.command)
+		}
+	}
+}
+
+func TestPullErrorKinds(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "check_remote_head", "false")
+	for _, test := range []struct {
+		name    string
+		files   map[string]string
+		fetches []error
+		kind    PullErrorKind
+	}{
+		{"network", map[string]string{"crontab": "* * * * * true\n"},
+			[]error{fmt.Errorf("fatal: unable to access 'https://example.com/jobs.git/': Could not resolve host: example.com")}, PullNetwork},
+		{"git", map[string]string{"crontab": "* * * * * true\n"},
+			[]error{fmt.Errorf("fatal: couldn't find remote ref master")}, PullGit},
+		{"file missing", map[string]string{"README": "no crontab here\n"}, nil, PullFileMissing},
+		{"parse", map[string]string{"crontab": "every minute, please\n"}, nil, PullParse},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			origin := newOrigin(t, test.files)
+			git := &fakeBackend{}
+			r := newTestRepo(t, git, origin)
+			git.failNext("Fetch", test.fetches...)
+			err := pullCrontab(NewManager(0), r, newCrontabQueue())
+			if pullErr, ok := err.(*PullError); !ok || pullErr.Kind != test.kind {
+				t.Errorf("pulling returned %#v, want a %s PullError", err, test.kind)
+			}
+		})
+	}
+}
+
+func TestCrontabQueueCoalesces(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./v1\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	m := NewManager(0)
+	queue := newCrontabQueue()
+
+	// Pull several versions without applying any of them.
+	for _, version := range []string{"v2", "v3"} {
+		if err := pullCrontab(m, r, queue); err != nil {
+			t.Fatal(err)
+		}
+		pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./" + version + "\n"}, version)
+	}
+	done := make(chan error)
+	go func() { done <- pullCrontab(m, r, queue) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("pulling is blocked on applying")
+	}
+	if pending, superseded, lastApplied := queue.stats(); pending != 1 || superseded != 2 || !lastApplied.IsZero() {
+		t.Errorf("pending=%d superseded=%d lastApplied=%s, want 1 pending, 2 superseded, and none applied",
+			pending, superseded, lastApplied)
+	}
+
+	entries := <-queue.updates
+	if len(entries) != 1 || entries[0].Command != "./v3" {
+		t.Errorf("applied %v, want only the latest crontab, ./v3", entries)
+	}
+	queue.applied()
+	if pending, _, lastApplied := queue.stats(); pending != 0 || lastApplied.IsZero() {
+		t.Errorf("pending=%d lastApplied=%s after applying, want none pending, and the time applied", pending, lastApplied)
+	}
+}
+
+func TestRecloneCorruptCrontabClone(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "check_remote_head", "false")
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./hourly\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	m := NewManager(0)
+	queue := newCrontabQueue()
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./hourly\n0 0 * * * ./daily\n"}, "add an entry")
+
+	// Corrupt the clone by overwriting its objects, as a failing disk might.
+	err := filepath.Walk(filepath.Join(r.crontab.dir, ".git", "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		// Replace rather than overwrite it, since it may be hard-linked to origin's.
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte("garbage"), 0444)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxGitFailures; i++ {
+		err = pullCrontab(m, r, queue)
+		if err == nil {
+			t.Fatal("pulled into a corrupt clone")
+		}
+		checkHealth(r, r.crontab, "crontab clone", err)
+	}
+	if err := pullCrontab(m, r, queue); err != nil {
+		t.Fatalf("pulling still fails after failing %d times: %s", maxGitFailures, err)
+	}
+	if entries := <-queue.updates; len(entries) != 2 {
+		t.Errorf("read %d entries after recloning, want origin's 2", len(entries))
+	}
+}
+
+func TestPullFromMirror(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "check_remote_head", "false")
+	setFlag(t, "clone_attempts", "1")
+	primary := newOrigin(t, map[string]string{"crontab": "0 * * * * ./hourly\n"})
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	runGit(t, "", "clone", "-q", "--mirror", primary, mirror)
+	unreachable := filepath.Join(t.TempDir(), "unreachable.git")
+
+	// Cloning falls back to the mirror when the primary can't be reached.
+	r, err := NewClone(execGit{}, "jobs", []string{unreachable, mirror})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// Pulling switches to the mirror once the primary goes away.
+	r, err = NewClone(execGit{}, "jobs", []string{primary, mirror})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	m := NewManager(0)
+	queue := newCrontabQueue()
+	pushToOrigin(t, mirror, map[string]string{"crontab": "0 * * * * ./hourly\n0 0 * * * ./daily\n"}, "add an entry")
+	if err := os.Rename(primary, unreachable); err != nil {
+		t.Fatal(err)
+	}
+	err = pullCrontab(m, r, queue)
+	if pullErr, ok := err.(*PullError); !ok || pullErr.Kind != PullNetwork {
+		t.Fatalf("pulling from an unreachable primary returned %v, want a network error", err)
+	}
+	if source, err := r.FailOver(); err != nil {
+		t.Fatal(err)
+	} else if source != mirror {
+		t.Errorf("failed over to %s, want the mirror", source)
+	}
+	if err := pullCrontab(m, r, queue); err != nil {
+		t.Fatal(err)
+	}
+	if entries := <-queue.updates; len(entries) != 2 {
+		t.Errorf("read %d entries from the mirror, want 2", len(entries))
+	}
+}
+
+func TestRequireCleanAfter(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	run := func(command string) RunResult {
+		t.Helper()
+		return executeCommand(&EventBus{}, testJob(t, "# crony: produces=reports/*.csv require_clean_after\n* * * * * "+command), r, time.Now(), triggerSchedule, nil)
+	}
+
+	if result := run("mkdir -p reports; echo 1 > reports/a.csv"); result.Err != nil {
+		t.Fatalf("run producing only what it declares failed: %s", result.Err)
+	}
+	if originFile(t, origin, "master", "reports/a.csv") != "1\n" {
+		t.Error("declared output wasn't committed")
+	}
+
+	result := run("echo 2 > reports/a.csv; echo junk > scratch.tmp")
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "scratch.tmp") {
+		t.Errorf("run leaving an undeclared file returned %v, want it to fail naming the file", result.Err)
+	}
+	if originFile(t, origin, "master", "scratch.tmp") != "" || originFile(t, origin, "master", "reports/a.csv") != "1\n" {
+		t.Error("changes from a run that left an undeclared file were committed")
+	}
+	if originFile(t, origin, "master", ".fail") == "" {
+		t.Error("no .fail file committed for the run that left an undeclared file")
+	}
+}
+
+func TestCommitSubject(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	command := "for f in /etc/hostname /etc/hosts /etc/passwd; do wc -l $f; done > counts.txt; echo counted " +
+		"everything there was to count; exit 3"
+	executeCommand(&EventBus{}, testJob(t, "* * * * * "+command), r, time.Now(), triggerSchedule, nil)
+
+	msg := runGit(t, origin, "log", "-1", "--format=%B", "master")
+	parts := strings.SplitN(msg, "\n\n", 2)
+	if len(parts) != 2 {
+		t.Fatalf("commit message %q has no blank line between its subject and body", msg)
+	}
+	subject, body := parts[0], parts[1]
+	if want := "crony: " + slugify(command) + " (exit 3)"; subject != want {
+		t.Errorf("subject is %q, want %q", subject, want)
+	}
+	if len(subject) > 80 {
+		t.Errorf("subject is %d characters long, want a short one", len(subject))
+	}
+	if want := "$ " + command + "\ncounted everything there was to count\n"; !strings.HasPrefix(body, want) {
+		t.Errorf("body is %q, want it to start with %q", body, want)
+	}
+
+	setFlag(t, "commit_subject", "{command} exited {exit}")
+	executeCommand(&EventBus{}, testJob(t, "* * * * * date +%N > now.txt"), r, time.Now(), triggerSchedule, nil)
+	if got, want := runGit(t, origin, "log", "-1", "--format=%s", "master"), "date +%N > now.txt exited 0\n"; got != want {
+		t.Errorf("with -commit_subject, subject is %q, want %q", got, want)
+	}
+}
+
+func TestExitWhenIdle(t *testing.T) {
+	setUpGit(t)
+	// crony has no @reboot; run_on_start on an entry that isn't due again for a while does the same.
+	origin := newOrigin(t, map[string]string{"crontab": "# crony: run_on_start\n0 0 1 1 * echo ran > ran.txt\n"})
+
+	cmd := exec.Command(os.Args[0], "-logtostderr", "-exit_when_idle=1m", origin)
+	cmd.Env = append(os.Environ(), "CRONY_TEST_MAIN=1")
+	done := make(chan error, 1)
+	var output []byte
+	go func() {
+		var err error
+		output, err = cmd.CombinedOutput()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("crony exited with %s\n%s", err, output)
+		}
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		<-done
+		t.Fatalf("crony didn't exit once its only run was done\n%s", output)
+	}
+	if got := originFile(t, origin, "master", "ran.txt"); got != "ran\n" {
+		t.Errorf("ran.txt in origin is %q, want the run on start to have finished before exiting", got)
+	}
+}
+
+func TestDeadlineNext(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "kill_grace_period", "200ms")
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+
+	start := time.Now()
+	result := executeCommand(&EventBus{}, testJob(t, "# crony: deadline=next deadline_margin=300ms\n@every 3s sleep 30"),
+		r, start, triggerSchedule, nil)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "timed out") {
+		t.Errorf("slow run returned %v, want it to time out", result.Err)
+	}
+	if elapsed := time.Since(start); elapsed >= 3*time.Second {
+		t.Errorf("slow run took %s, overrunning its next run in 3s", elapsed)
+	}
+
+	result = executeCommand(&EventBus{}, testJob(t, "# crony: deadline=next deadline_margin=5s\n@every 3s true"),
+		r, time.Now(), triggerSchedule, nil)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "no time to run") {
+		t.Errorf("run with a margin longer than its interval returned %v, want it not to run", result.Err)
+	}
+}
+
+func TestSummarizeChanges(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n", "data.txt": "old\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	message := func(lines string) string {
+		t.Helper()
+		if result := executeCommand(&EventBus{}, testJob(t, lines), r, time.Now(), triggerSchedule, nil); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		return runGit(t, origin, "log", "-1", "--format=%b", "master")
+	}
+
+	got := message("# crony: summarize_changes\n* * * * * echo new > data.txt; mkdir -p sub; echo b > sub/added.txt")
+	if want := "\nchanged:\n  data.txt\n  sub/added.txt\n"; !strings.Contains(got, want) {
+		t.Errorf("silent run's commit message is %q, want it to list the changed files: %q", got, want)
+	}
+	got = message("# crony: summarize_changes\n* * * * * echo newer > data.txt; echo wrote data.txt")
+	if strings.Contains(got, "changed:") {
+		t.Errorf("commit message of a run with output is %q, want just its output", got)
+	}
+	got = message("* * * * * echo newest > data.txt")
+	if strings.Contains(got, "changed:") {
+		t.Errorf("commit message without summarize_changes is %q, want no list of changed files", got)
+	}
+}
+
+func TestRunCommandKillsBackgroundChildren(t *testing.T) {
+	// Whether the process is gone, or only a zombie waiting for whichever process inherited it to reap it.
+	gone := func(pid int) bool {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return true
+		}
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		return len(fields) > 0 && fields[0] == "Z"
+	}
+	for _, test := range []struct {
+		name, command string
+		timeout       time.Duration
+	}{
+		{"exiting", "sleep 30 > /dev/null 2>&1 & echo $! > %s", 0},
+		{"holding its output open", "sleep 30 & echo $! > %s", 0},
+		{"timing out", "sleep 30 & echo $! > %s; wait", 200 * time.Millisecond},
+	} {
+		pidFile := filepath.Join(t.TempDir(), "pid")
+		start := time.Now()
+		runCommand(exec.Command("/bin/bash", "-c", fmt.Sprintf(test.command, pidFile)), test.timeout, nil)
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: took %s, waiting on the background child", test.name, elapsed)
+		}
+		pidText, err := os.ReadFile(pidFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(pidText)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, fmt.Sprintf("%s: background child %d is still running", test.name, pid), func() bool { return gone(pid) })
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "heartbeat", "1s")
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	start := time.Now()
+	newTestManager(t, execGit{}, nil, nil, origin)
+	beats := func() []string {
+		log := strings.TrimSpace(runGit(t, origin, "log", "--format=%s", "master", "--", heartbeatFile))
+		if log == "" {
+			return nil
+		}
+		return strings.Split(log, "\n")
+	}
+
+	eventually(t, "no heartbeats were committed", func() bool { return len(beats()) >= 2 })
+	elapsed := time.Since(start)
+	if n := len(beats()); time.Duration(n)*time.Second > elapsed {
+		t.Errorf("committed %d heartbeats in %s, want one a second", n, elapsed)
+	}
+	for _, subject := range beats() {
+		if subject != "crony: heartbeat" {
+			t.Errorf("heartbeat commit's subject is %q, want %q", subject, "crony: heartbeat")
+		}
+	}
+	beat, err := time.Parse(time.RFC3339, strings.TrimSpace(originFile(t, origin, "master", heartbeatFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beat.Before(start.Truncate(time.Second)) || beat.After(time.Now()) {
+		t.Errorf("heartbeat is %s, want the time of the latest beat, since %s", beat, start)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+var (
+	diffCrontabs = flag.Bool("diff", false,
+		"Instead of running, compare the old and new crontab files given as arguments, printing each entry that was "+
+			"added, removed, or rescheduled with its next run, and exiting with status 1 if there were any; "+
+			"comments, order, and how schedules are written are ignored")
+)
+
+// readCrontabFile parses the crontab file at path, along with the files it includes, as crony would.
+func readCrontabFile(path string) ([]crontab.Entry, error) {
+	options := crontab.ParseOptions{Seconds: *crontabSeconds, System: *systemCrontab}
+	return options.ParseCrontabFS(os.DirFS(filepath.Dir(path)), filepath.Base(path))
+}
+
+// diffCrontabFiles writes the changes to when commands run between the crontab files at oldPath and newPath to out,
+// one per line, with the time as of now at which each command next runs, or would have, and returns how many there were.
+func diffCrontabFiles(oldPath, newPath string, now time.Time, out io.Writer) (int, error) {
+	old, err := readCrontabFile(oldPath)
+	if err != nil {
+		return 0, err
+	}
+	new, err := readCrontabFile(newPath)
+	if err != nil {
+		return 0, err
+	}
+	changes := crontab.Diff(old, new)
+	for _, change := range changes {
+		var line string
+		switch change.Kind {
+		case crontab.Added:
+			line = fmt.Sprintf("%s: %s, next run %s",
+				describeCommand(change.New), change.New.Schedule.Cron(), formatNext(change.New.Schedule, now))
+		case crontab.Removed:
+			line = fmt.Sprintf("%s: %s, would have run next %s",
+				describeCommand(change.Old), change.Old.Schedule.Cron(), formatNext(change.Old.Schedule, now))
+		case crontab.Modified:
+			line = fmt.Sprintf("%s: %s -> %s, next run %s instead of %s",
+				describeCommand(change.New), change.Old.Schedule.Cron(), change.New.Schedule.Cron(),
+				formatNext(change.New.Schedule, now), formatNext(change.Old.Schedule, now))
+		}
+		if _, err := fmt.Fprintf(out, "%-8s %s\n", change.Kind, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(changes), nil
+}
+
+// describeCommand describes an entry's command, along with the user it runs as in a system crontab.
+func describeCommand(entry crontab.Entry) string {
+	if entry.User != "" {
+		return fmt.Sprintf("%s (as %s)", entry.Command, entry.User)
+	}
+	return entry.Command
+}
+
+// formatNext formats the next time after now at which schedule fires.
+func formatNext(schedule crontab.Schedule, now time.Time) string {
+	next := schedule.Next(now)
+	if next.IsZero() {
+		return "never"
+	}
+	return next.Format(time.RFC3339)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffCrontabFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, time.October, 15, 12, 0, 0, 0, time.UTC)
+	diff := func(old, new string) (int, string) {
+		t.Helper()
+		writeFile(t, filepath.Join(dir, "old"), old)
+		writeFile(t, filepath.Join(dir, "new"), new)
+		var out strings.Builder
+		n, err := diffCrontabFiles(filepath.Join(dir, "old"), filepath.Join(dir, "new"), now, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, out.String()
+	}
+
+	if n, out := diff(
+		"# Reports\n0 9 * * mon-fri ./report\n@hourly ./sync\n",
+		"@hourly ./sync\n# Weekday reports, for the team\n0 9 * * 1-5 ./report\n",
+	); n != 0 || out != "" {
+		t.Errorf("crontabs differing only in comments, order, and notation had %d changes:\n%s", n, out)
+	}
+
+	n, out := diff(
+		"0 9 * * * ./report\n@hourly ./sync\n",
+		"30 9 * * * ./report\n@hourly ./sync\n@daily ./backup\n",
+	)
+	want := "modified ./report: 0 9 * * * -> 30 9 * * *, next run 2026-10-16T09:30:00Z instead of 2026-10-16T09:00:00Z\n" +
+		"added    ./backup: 0 0 * * *, next run 2026-10-16T00:00:00Z\n"
+	if n != 2 || out != want {
+		t.Errorf("rescheduling an entry and adding another had %d changes:\n%s\nwant 2:\n%s", n, out, want)
+	}
+}
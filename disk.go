@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// diskUsage tracks the disk space used by clones and workdirs, so that it can be kept within -max_disk.
+type diskUsage struct {
+	mu   sync.Mutex
+	used int64
+}
+
+var disk diskUsage
+
+// reserve records that n more bytes are to be used by what, unless that would exceed -max_disk.
+func (d *diskUsage) reserve(what string, n int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if maxDisk > 0 && d.used+n > int64(maxDisk) {
+		free := int64(maxDisk) - d.used
+		if free < 0 {
+			free = 0
+		}
+		return fmt.Errorf("%s would use %s, but only %s of -max_disk=%s is free",
+			what, formatSize(n), formatSize(free), formatSize(int64(maxDisk)))
+	}
+	d.used += n
+	return nil
+}
+
+// adjust records that usage has changed by n bytes, which may be negative, whether or not that exceeds -max_disk.
+func (d *diskUsage) adjust(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.used += n
+}
+
+// dirSize returns the total size of the regular files under dir, not following symlinks,
+// and skipping the top-level directory named skip, if any.
+func dirSize(dir, skip string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Removed while walking, e.g. by git.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() && skip != "" && path == filepath.Join(dir, skip) {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// formatSize formats n bytes for humans, with a K, M, or G suffix if it's large enough.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d", n)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxDiskPreventsBranches(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n", "data.bin": strings.Repeat("x", 100<<10)})
+	r := newTestRepo(t, execGit{}, origin)
+	used := func() int64 {
+		disk.mu.Lock()
+		defer disk.mu.Unlock()
+		return disk.used
+	}
+
+	before := used()
+	setFlag(t, "max_disk", strconv.FormatInt(before+(10<<10), 10))
+	if w, err := r.Branch(); err == nil {
+		w.Close()
+		t.Fatal("created a workdir that doesn't fit within -max_disk")
+	} else if !strings.Contains(err.Error(), "-max_disk") {
+		t.Errorf("creating a workdir over budget failed with %q, want it to say why", err)
+	}
+	if after := used(); after != before {
+		t.Errorf("usage went from %d to %d after failing to create a workdir", before, after)
+	}
+	if _, err := NewClone(execGit{}, origin, []string{origin}); err == nil {
+		t.Error("cloned a repo that doesn't fit within -max_disk")
+	}
+
+	setFlag(t, "max_disk", strconv.FormatInt(before+(1<<20), 10))
+	w, err := r.Branch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used() <= before {
+		t.Error("creating a workdir didn't count towards -max_disk")
+	}
+	w.Close()
+	if after := used(); after != before {
+		t.Errorf("usage went from %d to %d after closing the workdir", before, after)
+	}
+}
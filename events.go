@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies a stage in a job's lifecycle, or something else that happened to a repo.
+type EventType string
+
+// Stages of a job's lifecycle, in the order they're published.
+const (
+	// JobStarted is published before a job's command runs.
+	JobStarted EventType = "JobStarted"
+	// JobFinished is published once a job's command exits, with its output and any error.
+	JobFinished EventType = "JobFinished"
+	// CommitPushed is published once a job's changes have been pushed to origin.
+	CommitPushed EventType = "CommitPushed"
+	// PushFailed is published if a job's changes couldn't be merged into master or pushed to origin.
+	PushFailed EventType = "PushFailed"
+	// JobCompleted is published last, with the outcome of the run.
+	JobCompleted EventType = "JobCompleted"
+)
+
+// Things that happen to a repo rather than to one of its jobs, whose events have no Command.
+const (
+	// CrontabRejected is published when -crontab_validator rejects a newly pulled crontab, with why.
+	CrontabRejected EventType = "CrontabRejected"
+)
+
+// Event describes something that happened to a job, or to its repo.
+type Event struct {
+	Type    EventType
+	Repo    string
+	Command string
+	Time    time.Time
+	// The command's combined output; set on JobFinished.
+	Output []byte
+	// Why the command or push failed, if it did; set on JobFinished, PushFailed, and JobCompleted.
+	// Why the crontab was rejected on CrontabRejected.
+	Err error
+	// How the run turned out; set on JobCompleted.
+	Result *RunResult
+}
+
+// EventBus delivers events to registered listeners.
+// A nil EventBus, or one without any listeners, discards events.
+type EventBus struct {
+	mu        sync.Mutex
+	listeners []func(Event)
+}
+
+// Subscribe registers f to be called with every subsequent event.
+// Listeners are called synchronously from the job publishing the event, so f should return quickly.
+func (b *EventBus) Subscribe(f func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, f)
+}
+
+// publish sends an event to each listener, filling in its time if unset.
+func (b *EventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	listeners := b.listeners
+	b.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, f := range listeners {
+		f(e)
+	}
+}
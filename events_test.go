@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSuccessfulRunEvents(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+
+	bus := &EventBus{}
+	var events []Event
+	bus.Subscribe(func(e Event) { events = append(events, e) })
+	j := testJob(t, "* * * * * echo hi | tee hi.txt")
+	executeCommand(bus, j, r, time.Now(), triggerSchedule, nil)
+
+	want := []EventType{JobStarted, JobFinished, CommitPushed, JobCompleted}
+	var got []EventType
+	for _, e := range events {
+		got = append(got, e.Type)
+		if e.Repo != origin || e.Command != j.Command || e.Time.IsZero() {
+			t.Errorf("%s event is for %s in %s at %s, want %s in %s, with a time", e.Type, e.Command, e.Repo, e.Time, j.Command, origin)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("events were %v, want %v", got, want)
+	}
+	if finished := events[1]; string(finished.Output) != "hi\n" || finished.Err != nil {
+		t.Errorf("%s event has output %q and error %v, want %q and none", JobFinished, finished.Output, finished.Err, "hi\n")
+	}
+	if completed := events[3]; completed.Result == nil || completed.Result.Outcome() != OutcomeCommitted {
+		t.Errorf("%s event has result %+v, want a committed run", JobCompleted, completed.Result)
+	}
+}
+
+func TestNilEventBusDiscardsEvents(t *testing.T) {
+	var bus *EventBus
+	bus.publish(Event{Type: JobStarted})
+	(&EventBus{}).publish(Event{Type: JobStarted})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Executor runs jobs' commands. The default, shellExecutor, runs each with bash in a process of its own.
+type Executor interface {
+	// Execute runs j's command in dir, with env, a list of "NAME=value" settings, added to its environment,
+	// returning its combined output and exit code, which is -1 if it didn't exit normally.
+	// It returns an error if the command couldn't be run, or didn't exit with 0,
+	// and should stop the command, returning promptly, once ctx is done.
+	Execute(ctx context.Context, j job, dir string, env []string) (output []byte, exitCode int, err error)
+}
+
+// shellExecutor is an Executor that runs commands with bash, applying the job's options for how to run it,
+// like its user, resource limits, and Docker image, and terminating it if it runs past the job's timeout,
+// which executeCommand sets for each run.
+type shellExecutor struct{}
+
+func (shellExecutor) Execute(ctx context.Context, j job, dir string, env []string) ([]byte, int, error) {
+	args := j.commandArgs(dir, env)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if j.credential != nil && j.dockerImage == "" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: j.credential}
+	}
+	out, err := runCommand(cmd, j.timeout, ctx.Done())
+	if errors.Is(err, exec.ErrNotFound) {
+		// Without a shell to report it, count a missing command as bash would.
+		return out, commandNotFoundExitCode, err
+	}
+	return out, exitCode(err), err
+}
+
+// terminateContext returns a context that's done once terminate is closed, or the returned cancel function is called.
+func terminateContext(terminate <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-terminate:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+// execution is a run of a command by a recordingExecutor.
+type execution struct {
+	command string
+	dir     string
+	env     []string
+}
+
+// recordingExecutor is an Executor that records the commands it's asked to run instead of running them,
+// writing each command to ran.txt in the directory it's asked to run it in, as a change to commit, and returning output.
+type recordingExecutor struct {
+	output string
+
+	mu         sync.Mutex
+	executions []execution
+}
+
+func (e *recordingExecutor) Execute(ctx context.Context, j job, dir string, env []string) ([]byte, int, error) {
+	e.mu.Lock()
+	e.executions = append(e.executions, execution{j.Command, dir, env})
+	e.mu.Unlock()
+	if err := os.WriteFile(filepath.Join(dir, "ran.txt"), []byte(j.Command+"\n"), 0644); err != nil {
+		return nil, -1, err
+	}
+	return []byte(e.output), 0, nil
+}
+
+func (e *recordingExecutor) recorded() []execution {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]execution(nil), e.executions...)
+}
+
+func TestManagerRunsCommandsWithExecutor(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	executor := &recordingExecutor{output: "ok\n"}
+	m, r := newTestManager(t, execGit{}, executor, nil, origin)
+
+	j := testJob(t, "0 0 * * * ./nightly.sh --all")
+	result, err := m.run(r, j, time.Now(), triggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	executions := executor.recorded()
+	if len(executions) != 1 {
+		t.Fatalf("executed %d commands, want 1: %v", len(executions), executions)
+	}
+	e := executions[0]
+	if e.command != "./nightly.sh --all" {
+		t.Errorf("executed %q, want %q", e.command, "./nightly.sh --all")
+	}
+	if e.dir == r.master.dir || e.dir == r.crontab.dir || !strings.HasPrefix(e.dir, os.TempDir()) {
+		t.Errorf("executed in %s, want a workdir of its own under %s", e.dir, os.TempDir())
+	}
+	if _, err := os.Stat(e.dir); !os.IsNotExist(err) {
+		t.Errorf("workdir %s is still there after the run", e.dir)
+	}
+	if got, want := strings.Join(e.env, " "), "CRONY_REPO="+origin; got != want {
+		t.Errorf("executed with env %s, want %s", got, want)
+	}
+	if got := originFile(t, origin, "master", "ran.txt"); got != "./nightly.sh --all\n" {
+		t.Errorf("ran.txt in origin is %q, want the command written by the executor", got)
+	}
+	if !strings.Contains(runGit(t, origin, "log", "-1", "--format=%B", "master"), "\nok\n") {
+		t.Error("the executor's output wasn't committed")
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	base, err := exec.Command("nice").Output()
+	if err != nil {
+		t.Skip("nice isn't installed")
+	}
+	niceness, err := strconv.Atoi(strings.TrimSpace(string(base)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := niceness + 5
+	if want > 19 {
+		want = 19
+	}
+
+	for _, test := range []struct {
+		lines, want string
+	}{
+		{"# crony: nice=5\n* * * * * nice", strconv.Itoa(want)},
+		{"# crony: memory_limit=512M\n* * * * * ulimit -v", "524288"},
+		{"# crony: cpu_limit=1m30s\n* * * * * ulimit -t", "90"},
+		{"# crony: max_processes=100\n* * * * * ulimit -u", "100"},
+	} {
+		out, _, err := shellExecutor{}.Execute(context.Background(), testJob(t, test.lines), t.TempDir(), nil)
+		if err != nil {
+			t.Errorf("%q: %s\n%s", test.lines, err, out)
+			continue
+		}
+		if got := strings.TrimSpace(string(out)); got != test.want {
+			t.Errorf("%q printed %s, want %s", test.lines, got, test.want)
+		}
+	}
+
+	for _, options := range []string{"nice=20", "nice=low", "ionice=fast", "ionice=idle:9", "memory_limit=1", "max_processes=0"} {
+		entries, err := crontab.ParseCrontab("# crony: " + options + "\n* * * * * true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newJob(entries[0]); err == nil {
+			t.Errorf("accepted %s", options)
+		}
+	}
+}
+
+func TestDockerRunner(t *testing.T) {
+	dir := t.TempDir()
+	j := testJob(t, "# crony: runner=docker:bash:5\n* * * * * echo hello > greeting.txt")
+	args := strings.Join(j.commandArgs(dir, []string{"CRONY_REPO=origin"}), " ")
+	for _, want := range []string{
+		"docker run --rm ",
+		" --volume " + dir + ":" + dir + " --workdir " + dir + " ",
+		" --env CRONY_REPO ",
+		" bash:5 /bin/bash -c echo hello > greeting.txt",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("running %s, want it to contain %q", args, want)
+		}
+	}
+
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker isn't available")
+	}
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	if result := executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if got := originFile(t, origin, "master", "greeting.txt"); got != "hello\n" {
+		t.Errorf("greeting.txt written in the container is %q in origin, want %q", got, "hello\n")
+	}
+}
+
+func TestSystemCrontabUser(t *testing.T) {
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("there's no user nobody")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("running commands as another user needs root")
+	}
+	entries, err := crontab.ParseSystemCrontab("0 0 * * * nobody id -u\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := newJob(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Command != "id -u" {
+		t.Errorf("command is %q, want %q", j.Command, "id -u")
+	}
+	// In /, since the test's own directories are only readable by root.
+	out, _, err := shellExecutor{}.Execute(context.Background(), j, "/", nil)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != u.Uid {
+		t.Errorf("ran as uid %s, want nobody's, %s", got, u.Uid)
+	}
+
+	entries, err = crontab.ParseSystemCrontab("0 0 * * * no-such-user id -u\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newJob(entries[0]); err == nil {
+		t.Error("accepted an entry for a user that doesn't exist")
+	}
+}
+
+func TestExecRunnerExpandsVariables(t *testing.T) {
+	t.Setenv("CRONY_TEST_GREETING", "hello")
+	j := testJob(t, "# crony: runner=exec\n* * * * * echo $CRONY_REPO ${CRONY_TEST_GREETING}! $CRONY_TEST_UNSET; 'quoted'")
+	out, _, err := shellExecutor{}.Execute(context.Background(), j, t.TempDir(), []string{"CRONY_REPO=origin"})
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	// With no shell, ; and quotes are just part of the arguments.
+	if got, want := string(out), "origin hello! ; 'quoted'\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	// The origin is a bare repo, so $CRONY_REPO/HEAD is its HEAD file.
+	j = testJob(t, "# crony: runner=exec\n* * * * * cp $CRONY_REPO/HEAD head.txt")
+	if result := executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if got := originFile(t, origin, "master", "head.txt"); got != "ref: refs/heads/master\n" {
+		t.Errorf("head.txt in origin is %q, want a copy of the HEAD file in $CRONY_REPO, %s", got, origin)
+	}
+}
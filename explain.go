@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+var (
+	explainSchedule = flag.Bool("explain", false,
+		"Instead of running, explain field by field whether the schedule given as the first argument, e.g. \"0 0 13 * 5\", "+
+			"fires at the RFC 3339 time given as the second, or now if there isn't one, exiting with status 1 if it doesn't")
+)
+
+// explainScheduleAt writes an explanation of whether schedule, as it would appear in a crontab, fires at t to out,
+// and determines whether it does.
+func explainScheduleAt(schedule string, t time.Time, out io.Writer) (bool, error) {
+	// The schedule is parsed as an entry without a command, so it can be given however a crontab could give it.
+	entry, err := crontab.ParseOptions{Seconds: *crontabSeconds}.ParseEntry(schedule)
+	if err != nil {
+		return false, err
+	}
+	if entry.Command != "" {
+		return false, fmt.Errorf("expected just a schedule, but it's followed by %q", entry.Command)
+	}
+	if _, err := fmt.Fprintln(out, entry.Schedule.Explain(t)); err != nil {
+		return false, err
+	}
+	return entry.Schedule.FiresAt(t), nil
+}
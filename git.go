@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -27,8 +32,12 @@ func tempDir() string {
 	for {
 		suffix := randomStr(chars, 16)
 		path = os.TempDir() + "/crony." + suffix
-		err := os.Mkdir(path, 0700)
+		err := os.Mkdir(path, os.FileMode(workdirMode))
 		if err == nil {
+			// Set the mode explicitly, since Mkdir's is subject to the umask.
+			if err := os.Chmod(path, os.FileMode(workdirMode)); err != nil {
+				panic(err)
+			}
 			break
 		} else if os.IsExist(err) {
 			continue
@@ -39,6 +48,14 @@ func tempDir() string {
 	return path
 }
 
+// runID distinguishes this process's temporary branches from any left behind by others, such as crony before a restart.
+var runID = newRunID()
+
+// newRunID returns an ID unique to this process, and to when it's called.
+func newRunID() string {
+	return fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid())
+}
+
 func cp(srcPath, dstPath string) error {
 	src, err := os.Open(srcPath)
 	if err != nil {
@@ -56,44 +73,373 @@ func cp(srcPath, dstPath string) error {
 	return dst.Close()
 }
 
+// pullMode determines how a workdir incorporates changes from origin.
+type pullMode string
+
+const (
+	// Rebase local commits on top of origin's.
+	pullRebase pullMode = "rebase"
+	// Fast-forward to origin's head, failing if local history has diverged.
+	pullFastForwardOnly pullMode = "ff-only"
+	// Overwrite local history with origin's, as FetchHead does.
+	pullReset pullMode = "reset"
+)
+
+// parsePullMode validates the name of a pullMode.
+func parsePullMode(s string) (pullMode, error) {
+	switch mode := pullMode(s); mode {
+	case pullRebase, pullFastForwardOnly, pullReset:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown pull mode %q; expected rebase, ff-only, or reset", s)
+}
+
+// rewriteMode determines what happens to local commits that haven't been pushed
+// when origin's history has been rewritten, so they can no longer be rebased onto it.
+type rewriteMode string
+
+const (
+	// Overwrite local history with origin's, dropping any unpushed commits.
+	rewriteReset rewriteMode = "reset"
+	// Overwrite local history with origin's, then cherry-pick any unpushed commits onto it.
+	rewritePreserve rewriteMode = "preserve"
+	// Leave local history alone, and stop running jobs until someone intervenes.
+	rewriteAbort rewriteMode = "abort"
+)
+
+// parseRewriteMode validates the name of a rewriteMode.
+func parseRewriteMode(s string) (rewriteMode, error) {
+	switch mode := rewriteMode(s); mode {
+	case rewriteReset, rewritePreserve, rewriteAbort:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown history rewrite mode %q; expected reset, preserve, or abort", s)
+}
+
+// commitMode determines which of a workdir's changes Commit includes.
+// The zero value includes all of them, including untracked files.
+type commitMode struct {
+	// Whether to only commit changes to files that are already tracked.
+	trackedOnly bool
+	// If set, only changes to these paths are committed.
+	paths []string
+	// Paths whose changes are committed regardless of the above, such as files crony itself writes.
+	include []string
+}
+
+// parseCommitMode parses "all", "tracked", or a comma-separated list of paths.
+func parseCommitMode(s string) (commitMode, error) {
+	switch s {
+	case "", "all":
+		return commitMode{}, nil
+	case "tracked":
+		return commitMode{trackedOnly: true}, nil
+	}
+	var mode commitMode
+	for _, p := range strings.Split(s, ",") {
+		if p == "" {
+			return commitMode{}, fmt.Errorf("empty path in commit paths: %s", s)
+		}
+		mode.paths = append(mode.paths, p)
+	}
+	return mode, nil
+}
+
+// all determines whether the mode commits every change.
+func (m commitMode) all() bool {
+	return !m.trackedOnly && len(m.paths) == 0
+}
+
 type repo struct {
-	name           string
+	name string
+	git  GitBackend
+	// Runs jobs' commands; if nil, they're run with bash.
+	executor       Executor
 	master         *workdir
 	mu             sync.Mutex
 	lastTempBranch int
+	// Strategy option (e.g. "ours", "theirs") used when rebasing job branches onto master; see Merge.
+	mergeStrategyOption string
+	// How to pull changes from origin; see workdir.Pull.
+	pullMode pullMode
+	// What to do with unpushed commits if origin's history is rewritten.
+	rewriteMode rewriteMode
+	// Most closed branch workdirs to keep around for reuse by Branch, and the workdirs currently kept.
+	poolSize int
+	pool     []*workdir
+	// Branch workdirs handed out by Branch and not yet closed.
+	active map[*workdir]bool
+	// Branch of origin that master tracks, as set by SetBranch; if empty, origin's default branch.
+	branch string
+	// Ref of origin, such as a tag, from which to read the crontab; if empty, it's read from the branch master tracks.
+	crontabRef string
+	// Path of the crontab in the repo.
+	crontabPath string
+	// How often to pull from origin; if zero, -pull_frequency.
+	pullFrequency time.Duration
+	// URLs of origin, followed by any mirrors of it to fetch from when it can't be reached; pushes always go to the first.
+	origins []string
+	// Index in origins of the URL currently fetched from.
+	source int
+	// Clone that only ever follows origin, from which the crontab is read,
+	// so that trouble merging or pushing in master doesn't hold up crontab updates.
+	crontab *workdir
+	// Held for reading by each run from branching off master until its branch is closed,
+	// and for writing while squashing master's history, so that no run is based on history rewritten under it.
+	history sync.RWMutex
+	// Held while appending to, rotating, or cleaning up the repo's logs in -output_log_dir,
+	// so that cleaning up never races a run's rotation.
+	logs sync.Mutex
 }
 
-// NewClone creates a local clone of a remote repo.
-func NewClone(name string, origin string) (*repo, error) {
+// notesRef is the ref under which notes are attached to commits.
+const notesRef = "refs/notes/commits"
+
+// NewClone creates a local clone of a remote repo, using git to operate on it.
+func NewClone(git GitBackend, name string, origins []string) (*repo, error) {
 	r := &repo{
-		name: name,
+		name:        name,
+		git:         git,
+		origins:     origins,
+		crontabPath: "crontab",
 		master: &workdir{
 			branch: "master",
 			dir:    tempDir(),
 		},
+		crontab: &workdir{
+			branch: "master",
+			dir:    tempDir(),
+		},
 	}
 	r.master.repo = r
-	if err := r.master.git("clone", origin, r.master.dir); err != nil {
+	r.crontab.repo = r
+	if err := r.clone(r.master); err != nil {
+		os.RemoveAll(r.crontab.dir)
+		return nil, err
+	}
+	if err := r.clone(r.crontab); err != nil {
+		r.master.remove()
+		return nil, err
+	}
+	// Keep notes attached to commits as they're rebased onto origin's latest changes.
+	if err := r.master.git("config", "notes.rewriteRef", notesRef); err != nil {
+		r.master.remove()
+		r.crontab.remove()
+		return nil, err
+	}
+	// The clones may have come from different mirrors, if origin flapped while cloning.
+	if err := r.setSource(r.source); err != nil {
+		r.master.remove()
+		r.crontab.remove()
+		return nil, err
+	}
+	// The clones can't be measured until they're made, so they're removed if they turn out not to fit.
+	var size int64
+	for _, w := range []*workdir{r.master, r.crontab} {
+		var err error
+		if w.size, err = dirSize(w.dir, ""); err != nil {
+			r.master.remove()
+			r.crontab.remove()
+			return nil, err
+		}
+		size += w.size
+	}
+	if err := disk.reserve("cloning "+name, size); err != nil {
+		r.master.size, r.crontab.size = 0, 0
+		r.master.remove()
+		r.crontab.remove()
 		return nil, err
 	}
 	return r, nil
 }
 
+// clone clones origin into w's directory, trying up to -clone_attempts times,
+// starting over in a fresh directory after each failure, and waiting longer before each retry.
+// Each attempt tries the URL currently fetched from, then each of the others in turn,
+// switching to fetching from whichever works.
+func (r *repo) clone(w *workdir) error {
+	delay, attempts := settings().cloneRetryDelay, settings().cloneAttempts
+	for attempt := 1; ; attempt++ {
+		var err error
+		for i := range r.origins {
+			source := (r.source + i) % len(r.origins)
+			if err = r.git.Clone(r.origins[source], w.dir); err == nil {
+				r.mu.Lock()
+				r.source = source
+				r.mu.Unlock()
+				return nil
+			}
+			os.RemoveAll(w.dir)
+			if err := os.Mkdir(w.dir, os.FileMode(workdirMode)); err != nil {
+				return err
+			}
+		}
+		os.RemoveAll(w.dir)
+		if attempt >= attempts {
+			return err
+		}
+		glog.Warningf("couldn't clone %s, retrying in %s: %s", r.name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		w.dir = tempDir()
+	}
+}
+
+// setSource switches master and the crontab clone to fetching from the source'th of origin's URLs.
+func (r *repo) setSource(source int) error {
+	for _, w := range []*workdir{r.master, r.crontab} {
+		// Not locking either workdir, so as not to wait on a stuck push; git locks the config file itself.
+		if err := w.setSource(source); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.source = source
+	r.mu.Unlock()
+	return nil
+}
+
+func (w *workdir) setSource(source int) error {
+	origins := w.repo.origins
+	if len(origins) == 1 {
+		return nil
+	}
+	if err := w.git("remote", "set-url", "origin", origins[source]); err != nil {
+		return err
+	}
+	return w.git("config", "remote.origin.pushurl", origins[0])
+}
+
+// Source returns the URL currently fetched from: origin's, or one of its mirrors'.
+func (r *repo) Source() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.origins[r.source]
+}
+
+// FailOver switches to fetching from the next of origin's mirrors, or back to origin after the last,
+// returning the URL it switched to. It does nothing if origin has no mirrors.
+func (r *repo) FailOver() (string, error) {
+	r.mu.Lock()
+	source := (r.source + 1) % len(r.origins)
+	r.mu.Unlock()
+	if err := r.setSource(source); err != nil {
+		return "", err
+	}
+	return r.origins[source], nil
+}
+
+// FailBack switches back to fetching from origin if it's currently fetching from a mirror and origin can be reached,
+// reporting whether it did.
+func (r *repo) FailBack() (bool, error) {
+	r.mu.Lock()
+	source := r.source
+	r.mu.Unlock()
+	if source == 0 {
+		return false, nil
+	}
+	if _, err := r.git.Run(r.crontab.dir, "ls-remote", r.origins[0], "HEAD"); err != nil {
+		return false, nil
+	}
+	if err := r.setSource(0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetBranch switches master to track the named branch of origin, rather than origin's default branch.
+func (r *repo) SetBranch(branch string) error {
+	m := r.master
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.git("checkout", "-B", branch, "--track", "origin/"+branch); err != nil {
+		return err
+	}
+	m.branch = branch
+	r.branch = branch
+	return nil
+}
+
+// Executor returns what runs the repo's jobs' commands.
+func (r *repo) Executor() Executor {
+	if r.executor == nil {
+		return shellExecutor{}
+	}
+	return r.executor
+}
+
+// remoteRef returns the ref of origin that master tracks: the branch set by SetBranch, or origin's HEAD.
+// Workdirs' local branch names, like temporary branches, needn't exist on origin.
+func (r *repo) remoteRef() string {
+	if r.branch != "" {
+		return r.branch
+	}
+	return "HEAD"
+}
+
+// tempBranchName returns a new name for a temporary branch, unique to this process.
 func (r *repo) tempBranchName() string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	name := fmt.Sprintf("temp%d", r.lastTempBranch)
+	name := fmt.Sprintf("crony/%s/%d", runID, r.lastTempBranch)
 	r.lastTempBranch++
 	return name
 }
 
 // Branch creates a new temporary branch off of master, and a new workdir with that branch checked out.
+// If a previously-closed workdir is available for reuse, its branch is reset to master instead.
 func (r *repo) Branch() (*workdir, error) {
+	r.mu.Lock()
+	var pooled *workdir
+	if n := len(r.pool); n > 0 {
+		pooled = r.pool[n-1]
+		r.pool = r.pool[:n-1]
+	}
+	r.mu.Unlock()
+	if pooled != nil {
+		if err := r.reuse(pooled); err != nil {
+			glog.Warningf("couldn't reuse %s, creating a new workdir instead: %s", pooled.dir, err)
+			if err := pooled.remove(); err != nil {
+				glog.Errorf("error removing %s: %s", pooled.dir, err)
+			}
+		} else {
+			r.register(pooled)
+			return pooled, nil
+		}
+	}
+
+	// A workdir starts out the same size as master's working tree; its .git is mostly symlinks.
+	size, err := dirSize(r.master.dir, ".git")
+	if err != nil {
+		return nil, err
+	}
+	if err := disk.reserve("a workdir for "+r.name, size); err != nil {
+		return nil, err
+	}
 	w := &workdir{
 		repo:   r,
 		branch: r.tempBranchName(),
 		dir:    tempDir(),
+		size:   size,
+		master: r.master.dir,
 	}
+	// Undo whatever was set up if anything fails part way, so that neither the directory nor the branch leaks.
+	created, branched := false, false
+	defer func() {
+		if created {
+			return
+		}
+		if branched {
+			m := r.master
+			m.mu.Lock()
+			if err := m.git("branch", "-D", w.branch); err != nil {
+				glog.Errorf("error deleting branch %s: %s", w.branch, err)
+			}
+			m.mu.Unlock()
+		}
+		os.RemoveAll(w.dir)
+		disk.adjust(-size)
+	}()
 	oldGitDir := path.Join(r.master.dir, ".git")
 	newGitDir := path.Join(w.dir, ".git")
 	if err := os.Mkdir(newGitDir, 0700); err != nil {
@@ -119,24 +465,170 @@ func (r *repo) Branch() (*workdir, error) {
 		return nil, err
 	}
 
+	base, err := m.revParse("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	w.base = base
 	if err := m.git("branch", w.branch); err != nil {
 		return nil, err
 	}
+	branched = true
 	if err := w.git("checkout", "-f", w.branch); err != nil {
 		return nil, err
 	}
+	created = true
+	r.register(w)
 	return w, nil
 }
 
+// register records that w has been handed out by Branch, until it's closed.
+func (r *repo) register(w *workdir) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		r.active = make(map[*workdir]bool)
+	}
+	r.active[w] = true
+}
+
+// ActiveWorkdir is a temporary branch, and the directory it's checked out in, that's in use.
+type ActiveWorkdir struct {
+	Branch string `json:"branch"`
+	Dir    string `json:"dir"`
+}
+
+// ActiveWorkdirs lists the workdirs Branch has handed out that haven't yet been closed, ordered by branch.
+// Those kept in the pool for reuse aren't included, since nothing's using them.
+func (r *repo) ActiveWorkdirs() []ActiveWorkdir {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var active []ActiveWorkdir
+	for w := range r.active {
+		active = append(active, ActiveWorkdir{Branch: w.branch, Dir: w.dir})
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Branch < active[j].Branch })
+	return active
+}
+
+// reuse resets a pooled workdir's branch to master, discarding anything left behind by its last use.
+func (r *repo) reuse(w *workdir) error {
+	m := r.master
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	base, err := m.revParse("HEAD")
+	if err != nil {
+		return err
+	}
+	if err := w.git("checkout", "-f", "-B", w.branch, base); err != nil {
+		return err
+	}
+	if err := w.git("clean", "-dfx"); err != nil {
+		return err
+	}
+	w.base = base
+	return nil
+}
+
 func (r *repo) Close() error {
+	r.mu.Lock()
+	pool := r.pool
+	r.pool = nil
+	r.mu.Unlock()
+	for _, w := range pool {
+		if err := w.remove(); err != nil {
+			glog.Errorf("error removing %s: %s", w.dir, err)
+		}
+	}
+	if err := r.crontab.Close(); err != nil {
+		glog.Errorf("error removing %s: %s", r.crontab.dir, err)
+	}
 	return r.master.Close()
 }
 
+// Fsck checks w's repository for corruption, returning an error describing any that git finds.
+func (w *workdir) Fsck() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.git("fsck", "--no-progress")
+}
+
+// Reclone replaces w, which must be master or the crontab clone, with a fresh clone of origin.
+// Any unpushed commits in w are lost. If w is master, pooled workdirs, which link into its .git, are discarded,
+// and workdirs still in use by jobs will fail to merge.
+func (r *repo) Reclone(w *workdir) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fresh := &workdir{repo: r, dir: tempDir()}
+	if err := r.clone(fresh); err != nil {
+		return err
+	}
+	dir := fresh.dir
+	if err := fresh.setSource(r.source); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if w == r.master {
+		if err := fresh.git("config", "notes.rewriteRef", notesRef); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		if r.branch != "" {
+			if err := fresh.git("checkout", "-B", r.branch, "--track", "origin/"+r.branch); err != nil {
+				os.RemoveAll(dir)
+				return err
+			}
+		}
+	}
+	// The clone replaces a corrupt one, so it's accounted for even if it doesn't fit in -max_disk.
+	size, err := dirSize(dir, "")
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	disk.adjust(size - w.size)
+	w.size = size
+
+	r.mu.Lock()
+	old := w.dir
+	w.dir = dir
+	var pool []*workdir
+	if w == r.master {
+		pool = r.pool
+		r.pool = nil
+	}
+	r.mu.Unlock()
+	for _, p := range pool {
+		if err := p.remove(); err != nil {
+			glog.Errorf("error removing %s: %s", p.dir, err)
+		}
+	}
+	return os.RemoveAll(old)
+}
+
 type workdir struct {
 	repo   *repo
 	mu     sync.Mutex
 	branch string
 	dir    string
+	// Commit this workdir's branch was created from, if it's a temporary branch.
+	base string
+	// Disk space accounted to this workdir, as of when it was created or last closed.
+	size int64
+	// Directory of the master this workdir's .git links into, if it's a temporary branch.
+	master string
+	// Fatal git errors in a row in this workdir, as counted by checkHealth.
+	fatalErrors int32
+	// Whether the commit last made in this workdir was given a fixed date, which merging it must keep.
+	fixedDate bool
+}
+
+// temporary reports whether w is one of the repo's temporary branch workdirs, rather than master or its crontab clone.
+func (w *workdir) temporary() bool {
+	return w != w.repo.master && w != w.repo.crontab
 }
 
 func (w *workdir) git(args ...string) error {
@@ -145,18 +637,40 @@ func (w *workdir) git(args ...string) error {
 }
 
 func (w *workdir) gitOutput(args ...string) ([]byte, error) {
-	glog.V(3).Infof("%s$ git %s", w.branch, strings.Join(args, " "))
-	cmd := exec.Command("git", args...)
-	cmd.Dir = w.dir
-	output, err := cmd.CombinedOutput()
-	glog.V(4).Infof(string(output))
+	return w.repo.git.Run(w.dir, args...)
+}
+
+// revParse returns the commit ID that rev refers to.
+func (w *workdir) revParse(rev string) (string, error) {
+	return w.repo.git.RevParse(w.dir, rev)
+}
+
+// UpToDate cheaply determines whether origin's HEAD, or the head of the branch the repo tracks,
+// is the same commit as the local HEAD, in which case there's nothing to pull.
+func (w *workdir) UpToDate() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ref := "HEAD"
+	if w.repo.branch != "" {
+		ref = "refs/heads/" + w.repo.branch
+	}
+	output, err := w.gitOutput("ls-remote", "origin", ref)
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return false, fmt.Errorf("origin has no %s", ref)
+	}
+	local, err := w.revParse("HEAD")
 	if err != nil {
-		return output, fmt.Errorf("%s\n%s", output, err)
+		return false, err
 	}
-	return output, nil
+	return fields[0] == local, nil
 }
 
-// Pull latest changes from origin, and rebase any local changes on top of origin's head.
+// Pull latest changes from origin according to the repo's pull mode:
+// by default, rebase any local changes on top of origin's head.
 // If that's not possible, return an error, leaving the workdir as it was.
 func (w *workdir) Pull() error {
 	w.mu.Lock()
@@ -164,13 +678,52 @@ func (w *workdir) Pull() error {
 	return w.pull()
 }
 
-// FetchHead fetches the current branch from origin, overwrites the local HEAD with origin's HEAD,
+// FetchHead fetches the branch the repo tracks from origin, overwrites the local HEAD with it,
 // and resets the local workdir to HEAD.
 // This will drop any local changes, committed or not!
 func (w *workdir) FetchHead() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.git("fetch", "origin", w.branch); err != nil {
+	return w.fetchHead()
+}
+
+// Upstream returns the commit ID of origin's branch as of the last fetch.
+func (w *workdir) Upstream() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.revParse("@{upstream}")
+}
+
+// ResetPreserving is like FetchHead, but then cherry-picks the commits made since upstream,
+// as returned by Upstream before fetching, onto origin's head.
+// Commits that no longer apply are dropped, and listed in the returned error.
+func (w *workdir) ResetPreserving(upstream string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	output, err := w.gitOutput("rev-list", "--reverse", upstream+"..HEAD")
+	if err != nil {
+		return err
+	}
+	commits := strings.Fields(string(output))
+	if err := w.fetchHead(); err != nil {
+		return err
+	}
+	var dropped []string
+	for _, commit := range commits {
+		if err := w.git("cherry-pick", "--allow-empty", commit); err != nil {
+			w.git("cherry-pick", "--abort")
+			dropped = append(dropped, commit)
+		}
+	}
+	if len(dropped) > 0 {
+		return fmt.Errorf("dropped %d of %d unpushed commits that no longer apply: %s",
+			len(dropped), len(commits), strings.Join(dropped, " "))
+	}
+	return nil
+}
+
+func (w *workdir) fetchHead() error {
+	if err := w.repo.git.Fetch(w.dir, w.repo.remoteRef()); err != nil {
 		return err
 	}
 	if err := w.git("reset", "--hard", "FETCH_HEAD"); err != nil {
@@ -183,68 +736,522 @@ func (w *workdir) FetchHead() error {
 }
 
 func (w *workdir) pull() error {
-	if err := w.git("pull", "--rebase"); err != nil {
-		w.git("rebase", "--abort")
+	switch w.repo.pullMode {
+	case pullFastForwardOnly:
+		return w.repo.git.Pull(w.dir, true)
+	case pullReset:
+		return w.fetchHead()
+	}
+	return w.repo.git.Pull(w.dir, false)
+}
+
+// FSAt fetches ref from origin, and returns the files as of that ref, along with the commit ID it refers to.
+func (w *workdir) FSAt(ref string) (fs.FS, string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.repo.git.Fetch(w.dir, ref); err != nil {
+		return nil, "", err
+	}
+	commit, err := w.revParse("FETCH_HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	return commitFS{w, commit}, commit, nil
+}
+
+// FSAtHead returns the files in w's repository as of the commit w has checked out, and that commit's ID.
+// Unlike w's working tree, they stay the same however w is reset or pulled while they're being read.
+func (w *workdir) FSAtHead() (fs.FS, string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	commit, err := w.revParse("HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	return commitFS{w, commit}, commit, nil
+}
+
+// commitFS is the files in a workdir's repository as of a commit.
+type commitFS struct {
+	w      *workdir
+	commit string
+}
+
+// ReadFile returns the contents of the named file as of the commit.
+// If the file doesn't exist as of the commit, the error satisfies os.IsNotExist.
+func (c commitFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	c.w.mu.Lock()
+	defer c.w.mu.Unlock()
+	listing, err := c.w.gitOutput("ls-tree", c.commit, "--", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(listing) == 0 {
+		return nil, &fs.PathError{Op: "read", Path: name + " at " + c.commit, Err: fs.ErrNotExist}
+	}
+	return c.w.gitOutput("cat-file", "blob", c.commit+":"+name)
+}
+
+// Open opens the named file as of the commit, reading all of its contents.
+func (c commitFS) Open(name string) (fs.File, error) {
+	contents, err := c.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &commitFile{bytes.NewReader(contents), commitFileInfo{path.Base(name), int64(len(contents))}}, nil
+}
+
+// commitFile is a file opened from a commitFS.
+type commitFile struct {
+	*bytes.Reader
+	info commitFileInfo
+}
+
+func (f *commitFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *commitFile) Close() error               { return nil }
+
+// commitFileInfo describes a commitFile.
+type commitFileInfo struct {
+	name string
+	size int64
+}
+
+func (i commitFileInfo) Name() string       { return i.name }
+func (i commitFileInfo) Size() int64        { return i.size }
+func (i commitFileInfo) Mode() fs.FileMode  { return 0444 }
+func (i commitFileInfo) ModTime() time.Time { return time.Time{} }
+func (i commitFileInfo) IsDir() bool        { return false }
+func (i commitFileInfo) Sys() interface{}   { return nil }
+
+// VerifyLastCommit checks the GPG signature of the most recent commit as of rev that changed the named file.
+// Signatures are checked against the keys in the keyring of the user crony runs as.
+func (w *workdir) VerifyLastCommit(rev, file string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	output, err := w.gitOutput("log", "-1", "--format=%H", rev, "--", file)
+	if err != nil {
 		return err
 	}
+	commit := strings.TrimSpace(string(output))
+	if commit == "" {
+		return fmt.Errorf("no commit changed %s", file)
+	}
+	if err := w.git("verify-commit", commit); err != nil {
+		return fmt.Errorf("commit %s has no valid signature: %s", commit, err)
+	}
 	return nil
 }
 
-// HasChanges determines whether this workdir has un-committed changes, staged or not.
-func (w *workdir) HasChanges() (bool, error) {
-	output, err := w.gitOutput("status", "-s")
+// HasChanges determines whether this workdir has un-committed changes, staged or not,
+// that would be committed in the given mode.
+func (w *workdir) HasChanges(mode commitMode) (bool, error) {
+	var output []byte
+	var err error
+	switch {
+	case mode.all():
+		output, err = w.repo.git.Status(w.dir)
+	case mode.trackedOnly:
+		output, err = w.gitOutput("status", "-s", "--untracked-files=no")
+	default:
+		output, err = w.gitOutput(append([]string{"status", "-s", "--"}, mode.paths...)...)
+	}
+	if err != nil || len(output) > 0 || len(mode.include) == 0 {
+		return len(output) > 0, err
+	}
+	output, err = w.gitOutput(append([]string{"status", "-s", "--"}, mode.include...)...)
+	return len(output) > 0, err
+}
+
+// ChangedFiles lists the files, relative to the workdir, that differ from the last commit, including untracked ones.
+func (w *workdir) ChangedFiles() ([]string, error) {
+	output, err := w.gitOutput("status", "--porcelain", "-z", "--untracked-files=all")
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return len(output) > 0, nil
+	var files []string
+	entries := strings.Split(string(output), "\x00")
+	for i := 0; i < len(entries); i++ {
+		if len(entries[i]) < 4 {
+			continue
+		}
+		files = append(files, entries[i][3:])
+		// Renames and copies are followed by the path they came from.
+		if status := entries[i][:2]; strings.ContainsAny(status, "RC") {
+			i++
+		}
+	}
+	return files, nil
+}
+
+// Unchanged determines whether the named files are the same as they were in the last commit.
+func (w *workdir) Unchanged(paths ...string) (bool, error) {
+	output, err := w.gitOutput(append([]string{"status", "-s", "--"}, paths...)...)
+	return len(output) == 0, err
 }
 
-func (w *workdir) Commit(msg string) error {
+// Commit commits the workdir's changes that are included by the given mode,
+// then discards any it didn't include, so they can't get in the way of merging the commit.
+// If date isn't zero, it's the commit's author date, and once it's merged, its commit date too,
+// so that committing the same changes on the same parent at the same date always makes the same commit.
+func (w *workdir) Commit(msg string, mode commitMode, date time.Time) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.git("add", "."); err != nil {
+	w.fixedDate = !date.IsZero()
+	if mode.all() && !w.fixedDate {
+		return w.repo.git.Commit(w.dir, msg)
+	}
+	if mode.all() {
+		if err := w.git("add", "-A", "."); err != nil {
+			return err
+		}
+	}
+	if mode.trackedOnly {
+		if err := w.git("add", "-u"); err != nil {
+			return err
+		}
+	}
+	paths := append(append([]string(nil), mode.paths...), mode.include...)
+	for _, p := range paths {
+		// Adding a path that neither exists nor is tracked is an error, so only add paths with changes.
+		output, err := w.gitOutput("status", "-s", "--", p)
+		if err != nil {
+			return err
+		}
+		if len(output) == 0 {
+			continue
+		}
+		if err := w.git("add", "-A", "--", p); err != nil {
+			return err
+		}
+	}
+	args := []string{"commit", "-m", msg}
+	if w.fixedDate {
+		args = append(args, "--date", date.Format(time.RFC3339))
+	}
+	if err := w.git(args...); err != nil {
+		return err
+	}
+	if mode.all() {
+		return nil
+	}
+	if err := w.git("reset", "--hard"); err != nil {
 		return err
 	}
-	return w.git("commit", "-a", "-m", msg)
+	return w.git("clean", "-df")
 }
 
+// Merge rebases other's commits onto this workdir's branch, then fast-forwards this branch to it.
+// Only commits made since other was branched are rebased, so this works even if history was squashed meanwhile.
+// Paths marked "merge=union" in .gitattributes have their conflicting lines kept from both sides,
+// which lets jobs append to the same file; if the repo has a merge strategy option set,
+// it's passed to the rebase to resolve any other conflicts.
+// If other's commit has a fixed date, it's rebased even if it needn't be, to make that its commit date as well.
 func (w *workdir) Merge(other *workdir) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	other.mu.Lock()
 	defer other.mu.Unlock()
 
-	if err := other.git("rebase", w.branch); err != nil {
+	args := []string{"rebase"}
+	if opt := w.repo.mergeStrategyOption; opt != "" {
+		args = append(args, "-X", opt)
+	}
+	if other.fixedDate {
+		args = append(args, "--force-rebase", "--committer-date-is-author-date")
+	}
+	if other.base != "" {
+		args = append(args, "--onto", w.branch, other.base)
+	} else {
+		args = append(args, w.branch)
+	}
+	if err := other.git(args...); err != nil {
+		other.git("rebase", "--abort")
 		return err
 	}
-	if err := w.git("merge", "--ff-only", other.branch); err != nil {
+	return w.repo.git.Merge(w.dir, other.branch)
+}
+
+// AddNote attaches note to commit, replacing any note it already had.
+func (w *workdir) AddNote(commit, note string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// The note is passed in a file, since it may be too long for an argument.
+	f, err := ioutil.TempFile("", "crony-note")
+	if err != nil {
 		return err
 	}
-	return nil
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(note); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return w.git("notes", "--ref", notesRef, "add", "-f", "-F", f.Name(), commit)
+}
+
+// PushNotes pushes notes to origin, first merging in any that have been pushed since, if need be.
+func (w *workdir) PushNotes() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.git("push", "origin", notesRef); err == nil {
+		return nil
+	}
+	if err := w.git("fetch", "origin", "+"+notesRef+":refs/notes/origin"); err != nil {
+		return err
+	}
+	if err := w.git("notes", "--ref", notesRef, "merge", "-s", "union", "refs/notes/origin"); err != nil {
+		return err
+	}
+	return w.git("push", "origin", notesRef)
 }
 
+// If -push_allow_branches doesn't allow pushing to the branch of origin w tracks, it returns an error wrapping
+// errPushNotAllowed without pushing, leaving w's commits in place.
 func (w *workdir) Push() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.git("push"); err != nil {
+	if err := w.checkPushAllowed(); err != nil {
+		return err
+	}
+	if err := w.repo.git.Push(w.dir); err != nil {
 		if err := w.pull(); err != nil {
 			return err
 		}
-		return w.git("push")
+		return w.repo.git.Push(w.dir)
 	}
 	return nil
 }
 
+// errPushNotAllowed is wrapped by errors from pushing to a branch of origin that -push_allow_branches doesn't allow.
+var errPushNotAllowed = errors.New("not allowed by -push_allow_branches")
+
+// checkPushAllowed returns an error wrapping errPushNotAllowed if -push_allow_branches is set,
+// and none of the globs in it match branch.
+func checkPushAllowed(branch string) error {
+	allowed := settings().pushAllowBranches
+	if allowed == "" {
+		return nil
+	}
+	for _, pattern := range strings.Split(allowed, ",") {
+		if matched, _ := path.Match(strings.TrimSpace(pattern), branch); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("not pushing to %s: %w", branch, errPushNotAllowed)
+}
+
+// checkPushAllowed returns an error wrapping errPushNotAllowed if -push_allow_branches doesn't allow pushing
+// to the branch of origin that w tracks. w.mu must be held.
+func (w *workdir) checkPushAllowed() error {
+	if settings().pushAllowBranches == "" {
+		return nil
+	}
+	upstream, err := w.gitOutput("rev-parse", "--abbrev-ref", "@{upstream}")
+	if err != nil {
+		return err
+	}
+	return checkPushAllowed(strings.TrimPrefix(strings.TrimSpace(string(upstream)), "origin/"))
+}
+
+// Keep preserves w's branch, as of its current commit, under name, both locally and on origin,
+// so that it outlives w.
+func (w *workdir) Keep(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := checkPushAllowed(name); err != nil {
+		return err
+	}
+	if err := w.git("branch", name, "HEAD"); err != nil {
+		return err
+	}
+	return w.git("push", "origin", name)
+}
+
+// squashFormat is the message of the commit Squash leaves in place of those it combines, given how many it combined.
+const squashFormat = "Squashed %d commits of history"
+
+// Squash rewrites history so that HEAD has at most depth commits, by combining the oldest ones into a single commit,
+// then force-pushes the result, leaving the working tree untouched.
+// Only commits crony made since the most recent one someone else made are combined, so that no one else's commit
+// is rewritten, along with its signature; history is left longer than depth if that's what it takes.
+// If origin changes while squashing, the squash is abandoned and local history is left as it was.
+func (w *workdir) Squash(depth int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if depth < 1 {
+		return fmt.Errorf("can't squash history to fewer than 1 commit")
+	}
+	if err := w.checkPushAllowed(); err != nil {
+		return err
+	}
+	if err := w.pull(); err != nil {
+		return err
+	}
+	output, err := w.gitOutput("rev-list", "--count", "--first-parent", "HEAD")
+	if err != nil {
+		return err
+	}
+	var count int
+	if _, err := fmt.Sscan(string(output), &count); err != nil {
+		return fmt.Errorf("couldn't count commits: %s", err)
+	}
+	if count <= depth {
+		return nil
+	}
+	output, err = w.gitOutput("log", "--first-parent",
+		"--format=%H"+fieldSeparator+"%s"+fieldSeparator+"%(trailers:only,unfold)"+recordSeparator)
+	if err != nil {
+		return err
+	}
+	// How many of the newest commits crony made.
+	ours := 0
+	for _, commit := range strings.Split(string(output), recordSeparator) {
+		fields := strings.SplitN(strings.TrimSpace(commit), fieldSeparator, 3)
+		if len(fields) != 3 || !cronyCommit(fields[1], fields[2]) {
+			break
+		}
+		ours++
+	}
+	squashed := ours - depth + 1
+	if squashed < 2 {
+		glog.V(1).Infof("not squashing %s, since only %d of its newest commits were made by crony", w.branch, ours)
+		return nil
+	}
+
+	head, err := w.revParse("HEAD")
+	if err != nil {
+		return err
+	}
+	oldest := fmt.Sprintf("HEAD~%d", depth-1)
+	args := []string{"commit-tree", "-m", fmt.Sprintf(squashFormat, squashed), oldest + "^{tree}"}
+	if ours < count {
+		// Keep the commit someone else made, and everything before it.
+		args = append(args, "-p", fmt.Sprintf("HEAD~%d", ours))
+	}
+	output, err = w.gitOutput(args...)
+	if err != nil {
+		return err
+	}
+	root := strings.TrimSpace(string(output))
+	if err := w.git("rebase", "--onto", root, oldest); err != nil {
+		w.git("rebase", "--abort")
+		return err
+	}
+	if err := w.git("push", "--force-with-lease"); err != nil {
+		if err := w.git("reset", "--hard", head); err != nil {
+			glog.Errorf("unable to restore %s to %s after failed squash: %s", w.branch, head, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// cronyCommit reports whether a commit with the given subject and trailers is one crony made:
+// a run's, a heartbeat, or one left by squashing.
+func cronyCommit(subject, trailers string) bool {
+	var squashed int
+	if _, err := fmt.Sscanf(subject, squashFormat, &squashed); err == nil && subject == fmt.Sprintf(squashFormat, squashed) {
+		return true
+	}
+	if subject == heartbeatSubject {
+		return true
+	}
+	for _, line := range strings.Split(trailers, "\n") {
+		if strings.HasPrefix(line, commandTrailer+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+// Close cleans up a workdir, deleting its branch and directory,
+// unless there's room to keep it for reuse in the repo's pool.
 func (w *workdir) Close() error {
+	r := w.repo
+	if w.temporary() {
+		// Account for whatever the job the workdir was used for left behind.
+		if size, err := dirSize(w.dir, ""); err == nil {
+			disk.adjust(size - w.size)
+			w.size = size
+		}
+		r.mu.Lock()
+		delete(r.active, w)
+		if len(r.pool) < r.poolSize && w.master == r.master.dir {
+			r.pool = append(r.pool, w)
+			r.mu.Unlock()
+			return nil
+		}
+		r.mu.Unlock()
+	}
+	return w.remove()
+}
+
+func (w *workdir) remove() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.repo.master != w {
+	// A workdir branched from a master that's since been recloned has nothing left to delete in it.
+	if w.temporary() && w.master == w.repo.master.dir {
 		if err := w.repo.master.git("branch", "-D", w.branch); err != nil {
 			return err
 		}
 	}
-	if err := os.RemoveAll(w.dir); err != nil {
+	if err := removeDir(w.dir); err != nil {
+		glog.Warningf("%s", err)
+		// Only count what's left.
+		if size, sizeErr := dirSize(w.dir, ""); sizeErr == nil {
+			disk.adjust(size - w.size)
+			w.size = size
+		}
 		return err
 	}
+	disk.adjust(-w.size)
+	w.size = 0
 	return nil
 }
+
+// removeRetryDelay is how long removeDir waits before trying again to remove a directory it couldn't,
+// e.g. because a process the job leaked still has files in it open.
+const removeRetryDelay = time.Second
+
+// maxLeftovers is the most paths left behind in a directory that removeDir lists.
+const maxLeftovers = 10
+
+// removeDir removes dir and everything in it, checking that it's really gone,
+// and trying once more after removeRetryDelay if it isn't.
+// If it's still there, the error lists what was left behind, such as the .nfsXXXX files
+// that NFS keeps in place of deleted files that are still open.
+func removeDir(dir string) error {
+	err := os.RemoveAll(dir)
+	if _, statErr := os.Lstat(dir); err == nil && os.IsNotExist(statErr) {
+		return nil
+	}
+	time.Sleep(removeRetryDelay)
+	err = os.RemoveAll(dir)
+	if _, statErr := os.Lstat(dir); err == nil && os.IsNotExist(statErr) {
+		return nil
+	}
+	var leftovers []string
+	fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "." {
+			return nil
+		}
+		if len(leftovers) == maxLeftovers {
+			leftovers = append(leftovers, "...")
+			return fs.SkipAll
+		}
+		leftovers = append(leftovers, path)
+		return nil
+	})
+	if err == nil {
+		err = errors.New("it's still there")
+	}
+	if len(leftovers) == 0 {
+		return fmt.Errorf("couldn't remove %s: %s", dir, err)
+	}
+	return fmt.Errorf("couldn't remove %s: %s; left behind: %s", dir, err, strings.Join(leftovers, ", "))
+}
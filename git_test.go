@@ -0,0 +1,837 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+// setUpGit gives git an identity and a config of its own for the rest of the test,
+// and makes the temporary directories crony creates under a directory of the test's.
+func setUpGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	for name, value := range map[string]string{
+		"GIT_AUTHOR_NAME":     "crony",
+		"GIT_AUTHOR_EMAIL":    "crony@localhost",
+		"GIT_COMMITTER_NAME":  "crony",
+		"GIT_COMMITTER_EMAIL": "crony@localhost",
+		"GIT_CONFIG_GLOBAL":   "/dev/null",
+		"GIT_CONFIG_NOSYSTEM": "1",
+		"TMPDIR":              t.TempDir(),
+	} {
+		t.Setenv(name, value)
+	}
+}
+
+// runGit runs git with args in dir, failing the test if it fails, and returns its output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+// newOrigin creates a bare repo on branch master with a commit of files, by path, returning its path.
+func newOrigin(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "-q", "-b", "master", work)
+	for name, contents := range files {
+		writeFile(t, filepath.Join(work, name), contents)
+	}
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "initial commit")
+	origin := filepath.Join(dir, "origin.git")
+	runGit(t, dir, "clone", "-q", "--bare", work, origin)
+	return origin
+}
+
+// pushToOrigin commits files, by path, to origin's master from a clone of it, as if someone else had.
+func pushToOrigin(t *testing.T, origin string, files map[string]string, msg string) {
+	t.Helper()
+	work := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "clone", "-q", origin, work)
+	for name, contents := range files {
+		writeFile(t, filepath.Join(work, name), contents)
+	}
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "-m", msg)
+	runGit(t, work, "push", "-q")
+}
+
+func writeFile(t *testing.T, file, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestRepo clones origin with git, closing the clone at the end of the test.
+func newTestRepo(t *testing.T, git GitBackend, origin string) *repo {
+	t.Helper()
+	r, err := NewClone(git, origin, []string{origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// testJob makes a job of a crontab entry, along with any "# crony:" lines of options before it,
+// failing the test if it's invalid.
+func testJob(t *testing.T, lines string) job {
+	t.Helper()
+	entries, err := crontab.ParseCrontab(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%q has %d entries, want 1", lines, len(entries))
+	}
+	j, err := newJob(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// originFile returns the contents of file at rev in origin, or "" if it doesn't exist.
+func originFile(t *testing.T, origin, rev, file string) string {
+	t.Helper()
+	cmd := exec.Command("git", "--git-dir", origin, "show", fmt.Sprintf("%s:%s", rev, file))
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return string(output)
+}
+
+func TestMergeUnionAppends(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{
+		".gitattributes": "log.txt merge=union\n",
+		"log.txt":        "start\n",
+	})
+	r := newTestRepo(t, execGit{}, origin)
+
+	// Both branch off master before either merges, as concurrent jobs do.
+	var branches []*workdir
+	for _, line := range []string{"first", "second"} {
+		w, err := r.Branch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		writeFile(t, filepath.Join(w.dir, "log.txt"), "start\n"+line+"\n")
+		if err := w.Commit("append "+line, commitMode{}, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		branches = append(branches, w)
+	}
+	for _, w := range branches {
+		if err := r.master.Merge(w); err != nil {
+			t.Fatalf("merging %s: %s", w.branch, err)
+		}
+	}
+	if got, want := originFile(t, filepath.Join(r.master.dir, ".git"), "master", "log.txt"), "start\nfirst\nsecond\n"; got != want {
+		t.Errorf("log.txt after merging both is %q, want %q", got, want)
+	}
+}
+
+// commitCount returns how many commits there are on the first-parent history of rev in the repo at gitDir.
+func commitCount(t *testing.T, gitDir, rev string) int {
+	t.Helper()
+	var n int
+	fmt.Sscan(runGit(t, "", "--git-dir", gitDir, "rev-list", "--count", "--first-parent", rev), &n)
+	return n
+}
+
+func TestSquashHistory(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	run := func(i int) {
+		executeCommand(&EventBus{}, testJob(t, fmt.Sprintf("* * * * * echo %d > out-%d.txt", i, i)), r, time.Now(), triggerSchedule, nil)
+	}
+	run(0)
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * true\n"}, "run hourly")
+	human := runGit(t, origin, "rev-parse", "master")
+	for i := 1; i < 5; i++ {
+		run(i)
+	}
+	if got := commitCount(t, origin, "master"); got != 7 {
+		t.Fatalf("origin has %d commits after 5 runs, want 7", got)
+	}
+
+	// Of the 4 runs since someone else's commit, the newest 2 are kept as they are, and the others squashed into 1.
+	if err := r.master.Squash(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := commitCount(t, origin, "master"); got != 6 {
+		t.Errorf("origin has %d commits after squashing to 3, want 6", got)
+	}
+	if got := runGit(t, origin, "rev-parse", "master~3"); got != human {
+		t.Errorf("the commit someone else made is now %s, want it kept as %s", got, human)
+	}
+	for i := 0; i < 5; i++ {
+		file := fmt.Sprintf("out-%d.txt", i)
+		if got, want := originFile(t, origin, "master", file), fmt.Sprintf("%d\n", i); got != want {
+			t.Errorf("%s in origin is %q after squashing, want %q", file, got, want)
+		}
+	}
+
+	// The commit left by squashing is crony's, so it's squashed along with the runs after it.
+	for i := 5; i < 7; i++ {
+		run(i)
+	}
+	if err := r.master.Squash(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := commitCount(t, origin, "master"); got != 6 {
+		t.Errorf("origin has %d commits after squashing to 3 again, want 6", got)
+	}
+	if got := runGit(t, origin, "rev-parse", "master~3"); got != human {
+		t.Errorf("the commit someone else made is now %s, want it kept as %s", got, human)
+	}
+
+	// Nothing is squashed while the newest commits aren't crony's.
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 0 * * * true\n"}, "run daily")
+	if err := r.master.Squash(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := commitCount(t, origin, "master"); got != 7 {
+		t.Errorf("origin has %d commits after squashing with someone else's commit newest, want all 7", got)
+	}
+}
+
+func TestCompactHistoryWaitsForRuns(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	setFlag(t, "max_history_depth", "1")
+	setFlag(t, "pull_frequency", "10ms")
+	r := newTestRepo(t, execGit{}, origin)
+	for i := 0; i < 3; i++ {
+		executeCommand(&EventBus{}, testJob(t, fmt.Sprintf("* * * * * echo x > file-%d", i)), r, time.Now(), triggerSchedule, nil)
+	}
+	m := NewManager(0)
+	t.Cleanup(m.Shutdown)
+
+	// A run has a branch off master, so its history mustn't be rewritten yet.
+	r.history.RLock()
+	compactHistory(m, r)
+	time.Sleep(100 * time.Millisecond)
+	if got := commitCount(t, origin, "master"); got != 4 {
+		t.Errorf("origin has %d commits while a run had a branch, want all 4", got)
+	}
+	r.history.RUnlock()
+
+	deadline := time.Now().Add(10 * time.Second)
+	// The runs are squashed into one, after the initial commit.
+	for commitCount(t, origin, "master") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("history wasn't squashed once the run was done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := originFile(t, origin, "master", "file-2"); got != "x\n" {
+		t.Errorf("file-2 in origin is %q after squashing, want %q", got, "x\n")
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+
+	// Counts its runs in a file, printing the count.
+	const command = "n=$(cat n 2>/dev/null || echo 0); echo $((n+1)) | tee n"
+	for _, test := range []struct {
+		option, file, latest string
+	}{
+		{"output_file=reports/latest.txt", "reports/latest.txt", "2\n"},
+		{"output_file=", "outputs/n-cat-n-2-dev-null-echo-0-echo-n-1-tee-n.log", "4\n"},
+	} {
+		for run := 0; run < 2; run++ {
+			executeCommand(&EventBus{}, testJob(t, "# crony: "+test.option+"\n* * * * * "+command), r, time.Now(), triggerSchedule, nil)
+		}
+		if got := originFile(t, origin, "master", test.file); got != test.latest {
+			t.Errorf("with %s, %s in origin is %q, want the latest run's output, %q", test.option, test.file, got, test.latest)
+		}
+	}
+}
+
+func TestBranchReusesPooledWorkdirs(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	r.poolSize = 2
+
+	// Each run notes the workdir it ran in.
+	dirs := filepath.Join(t.TempDir(), "dirs")
+	for i := 0; i < 5; i++ {
+		executeCommand(&EventBus{}, testJob(t, fmt.Sprintf("* * * * * pwd >> %s; echo ./job-%d > ran.txt", dirs, i)), r, time.Now(), triggerSchedule, nil)
+	}
+	contents, err := os.ReadFile(dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := make(map[string]bool)
+	for _, dir := range strings.Fields(string(contents)) {
+		used[dir] = true
+	}
+	if len(used) != 1 {
+		t.Errorf("5 runs in a row used %d workdirs, want 1 reused", len(used))
+	}
+	// Each run wrote ran.txt on a branch reset to master, so each commit has just its own command.
+	for i := 0; i < 5; i++ {
+		if got, want := originFile(t, origin, fmt.Sprintf("master~%d", 4-i), "ran.txt"), fmt.Sprintf("./job-%d\n", i); got != want {
+			t.Errorf("run %d committed ran.txt %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestActiveWorkdirs(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+
+	var workdirs []*workdir
+	for i := 0; i < 2; i++ {
+		w, err := r.Branch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		workdirs = append(workdirs, w)
+	}
+	sort.Slice(workdirs, func(i, j int) bool { return workdirs[i].branch < workdirs[j].branch })
+	active := func() string {
+		var s []string
+		for _, w := range workdirs {
+			s = append(s, fmt.Sprint(ActiveWorkdir{Branch: w.branch, Dir: w.dir}))
+		}
+		return strings.Join(s, " ")
+	}
+	if got, want := fmt.Sprint(r.ActiveWorkdirs()), "["+active()+"]"; got != want {
+		t.Errorf("active workdirs are %s, want %s", got, want)
+	}
+
+	if err := workdirs[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	workdirs = workdirs[1:]
+	if got, want := fmt.Sprint(r.ActiveWorkdirs()), "["+active()+"]"; got != want {
+		t.Errorf("after closing one, active workdirs are %s, want %s", got, want)
+	}
+	if err := workdirs[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.ActiveWorkdirs(); len(got) != 0 {
+		t.Errorf("after closing both, active workdirs are %v, want none", got)
+	}
+}
+
+func TestBranchCleansUpAfterFailedCheckout(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	git := &fakeBackend{}
+	r := newTestRepo(t, git, origin)
+	tempDirs := func() []string {
+		entries, err := os.ReadDir(os.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	before := fmt.Sprint(tempDirs())
+	disk.mu.Lock()
+	used := disk.used
+	disk.mu.Unlock()
+
+	git.failNext("Run checkout", errors.New("unable to create symlink"))
+	if _, err := r.Branch(); err == nil {
+		t.Fatal("Branch succeeded despite the failed checkout")
+	}
+	if got := runGit(t, r.master.dir, "branch", "--list", "crony/*"); got != "" {
+		t.Errorf("branches left behind: %s", got)
+	}
+	if after := fmt.Sprint(tempDirs()); after != before {
+		t.Errorf("temp dirs were %s before the failed Branch, and %s after", before, after)
+	}
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+	if disk.used != used {
+		t.Errorf("%d bytes of disk still reserved for the failed workdir", disk.used-used)
+	}
+}
+
+// makeUnremovable makes file, and so the directory it's in, impossible to remove until the end of the test,
+// skipping the test if it can't.
+func makeUnremovable(t *testing.T, file string) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		dir := filepath.Dir(file)
+		if err := os.Chmod(dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(dir, 0755) })
+		return
+	}
+	// Root can remove anything it has permission to, but not immutable files.
+	if output, err := exec.Command("chattr", "+i", file).CombinedOutput(); err != nil {
+		t.Skipf("can't make %s immutable: %s\n%s", file, err, output)
+	}
+	t.Cleanup(func() { exec.Command("chattr", "-i", file).Run() })
+}
+
+func TestCloseReportsLeftovers(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	w, err := r.Branch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := filepath.Join(w.dir, "stuck", "held.txt")
+	writeFile(t, held, "still open\n")
+	makeUnremovable(t, held)
+
+	start := time.Now()
+	err = w.Close()
+	if err == nil || !strings.Contains(err.Error(), "left behind: stuck, stuck/held.txt") {
+		t.Errorf("closing a workdir that couldn't be removed returned %v, want an error listing what was left", err)
+	}
+	if elapsed := time.Since(start); elapsed < removeRetryDelay {
+		t.Errorf("gave up on removing the workdir after %s, want it to retry after %s", elapsed, removeRetryDelay)
+	}
+	if _, err := os.Stat(filepath.Join(w.dir, ".git")); !os.IsNotExist(err) {
+		t.Error("the rest of the workdir wasn't removed")
+	}
+	if len(r.ActiveWorkdirs()) != 0 {
+		t.Errorf("workdirs still active after closing: %v", r.ActiveWorkdirs())
+	}
+}
+
+func TestCommitModes(t *testing.T) {
+	setUpGit(t)
+	for _, test := range []struct {
+		mode      string
+		committed []string
+	}{
+		{"all", []string{"tracked.txt", "new.txt", "data/new.txt"}},
+		{"tracked", []string{"tracked.txt"}},
+		{"data", []string{"data/new.txt"}},
+	} {
+		origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n", "tracked.txt": "v1\n"})
+		r := newTestRepo(t, execGit{}, origin)
+		j := testJob(t, "# crony: commit="+test.mode+"\n* * * * * echo v2 > tracked.txt; echo v2 > new.txt; mkdir data; echo v2 > data/new.txt")
+		if result := executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		var committed []string
+		for _, file := range []string{"tracked.txt", "new.txt", "data/new.txt"} {
+			if originFile(t, origin, "master", file) == "v2\n" {
+				committed = append(committed, file)
+			}
+		}
+		if got, want := strings.Join(committed, " "), strings.Join(test.committed, " "); got != want {
+			t.Errorf("commit=%s committed changes to %s, want %s", test.mode, got, want)
+		}
+	}
+}
+
+func TestFetchHeadResetsToTrackedBranch(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	runGit(t, origin, "branch", "prod", "master")
+	r := newTestRepo(t, execGit{}, origin)
+	head := func(dir string) string { return strings.TrimSpace(runGit(t, dir, "rev-parse", "HEAD")) }
+	originHead := func(branch string) string { return strings.TrimSpace(runGit(t, origin, "rev-parse", branch)) }
+
+	// A job's workdir is on a temporary branch, which origin doesn't have.
+	w, err := r.Branch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	pushToOrigin(t, origin, map[string]string{"master.txt": "master\n"}, "change master")
+	if err := w.FetchHead(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := head(w.dir), originHead("master"); got != want {
+		t.Errorf("workdir on %s is at %s after FetchHead, want origin's master at %s", w.branch, got, want)
+	}
+
+	if err := r.SetBranch("prod"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.FetchHead(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := head(w.dir), originHead("prod"); got != want {
+		t.Errorf("workdir on %s is at %s after FetchHead, want origin's prod at %s", w.branch, got, want)
+	}
+}
+
+func TestSkipUnchangedOutput(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n", "status.txt": "ok\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	// The command changes another file each run, which alone isn't enough to be committed.
+	j := testJob(t, "# crony: output_file=out.log skip_unchanged_output\n* * * * * date +%s%N > stamp.txt; cat status.txt")
+	run := func() {
+		t.Helper()
+		if result := executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	before := commitCount(t, origin, "master")
+	run()
+	run()
+	if got := commitCount(t, origin, "master") - before; got != 1 {
+		t.Errorf("committed %d runs with identical output, want 1", got)
+	}
+	pushToOrigin(t, origin, map[string]string{"status.txt": "degraded\n"}, "change the output")
+	if err := pullMaster(r); err != nil {
+		t.Fatal(err)
+	}
+	before = commitCount(t, origin, "master")
+	run()
+	if got := commitCount(t, origin, "master") - before; got != 1 {
+		t.Errorf("committed %d runs once the output changed, want 1", got)
+	}
+	if got := originFile(t, origin, "master", "out.log"); got != "degraded\n" {
+		t.Errorf("out.log in origin is %q, want the latest output", got)
+	}
+}
+
+func TestTempBranchNamesUniqueAcrossRestarts(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	defer func(id string) { runID = id }(runID)
+
+	seen := make(map[string]bool)
+	for lifetime := 0; lifetime < 2; lifetime++ {
+		// Restart, as far as naming is concerned, leaving behind the previous lifetime's branches.
+		runID = newRunID()
+		r.lastTempBranch = 0
+		for i := 0; i < 3; i++ {
+			w, err := r.Branch()
+			if err != nil {
+				t.Fatalf("lifetime %d: %s", lifetime, err)
+			}
+			if seen[w.branch] {
+				t.Errorf("lifetime %d reused branch name %s", lifetime, w.branch)
+			}
+			seen[w.branch] = true
+			if !strings.HasPrefix(w.branch, "crony/"+runID+"/") {
+				t.Errorf("branch %s isn't named for run %s", w.branch, runID)
+			}
+			// Leak the first, as a crash would.
+			if i > 0 {
+				w.Close()
+			}
+		}
+	}
+}
+
+func TestOutputNotes(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	j := testJob(t, "# crony: output_notes\n* * * * * date > now.txt; seq 1 100")
+	if result := executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	var want strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintln(&want, i)
+	}
+	if got := runGit(t, origin, "notes", "show", "master"); got != want.String() {
+		t.Errorf("note on the run's commit is %q, want its output", got)
+	}
+	msg := runGit(t, origin, "log", "-1", "--format=%B", "master")
+	if strings.Contains(msg, "\n50\n") {
+		t.Errorf("commit message %q has the output, which should only be in the note", msg)
+	}
+	if !strings.Contains(msg, "$ date > now.txt; seq 1 100\n") {
+		t.Errorf("commit message %q doesn't have the command", msg)
+	}
+}
+
+func TestCloneRetries(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "clone_attempts", "3")
+	setFlag(t, "clone_retry_delay", "10ms")
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+
+	git := &fakeBackend{}
+	git.failNext("Clone", fmt.Errorf("fatal: the remote end hung up unexpectedly"), fmt.Errorf("fatal: the remote end hung up unexpectedly"))
+	r := newTestRepo(t, git, origin)
+	// Three attempts at master, then one at the crontab clone.
+	if got := len(git.called("Clone")); got != 4 {
+		t.Errorf("cloned %d times, want 4", got)
+	}
+	if got := strings.TrimSpace(runGit(t, r.master.dir, "rev-parse", "HEAD")); got != strings.TrimSpace(runGit(t, origin, "rev-parse", "master")) {
+		t.Errorf("master is at %s after retrying, want origin's head", got)
+	}
+	r.Close()
+
+	// Leave nothing behind once the attempts run out.
+	leftovers, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	git = &fakeBackend{}
+	git.failNext("Clone", fmt.Errorf("fatal: one"), fmt.Errorf("fatal: two"), fmt.Errorf("fatal: three"))
+	if _, err := NewClone(git, origin, []string{origin}); err == nil || err.Error() != "fatal: three" {
+		t.Errorf("cloning returned %v once the attempts ran out, want the last attempt's error", err)
+	}
+	if entries, err := os.ReadDir(os.TempDir()); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != len(leftovers) {
+		t.Errorf("left %d entries in %s after failing to clone, want %d", len(entries), os.TempDir(), len(leftovers))
+	}
+}
+
+func TestFixedCommitDateIsReproducible(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	// An identical copy of origin, down to its commit IDs.
+	copied := filepath.Join(t.TempDir(), "copy.git")
+	runGit(t, "", "clone", "-q", "--bare", origin, copied)
+	date := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	var heads []string
+	for i, o := range []string{origin, copied} {
+		if i > 0 {
+			// Let the wall clock move on, which mustn't change anything.
+			time.Sleep(1100 * time.Millisecond)
+		}
+		r := newTestRepo(t, execGit{}, o)
+		w, err := r.Branch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(w.dir, "report.txt"), "same content\n")
+		if err := w.Commit("same message", commitMode{}, date); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.master.Merge(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		heads = append(heads, strings.TrimSpace(runGit(t, r.master.dir, "rev-parse", "HEAD")))
+		dates := runGit(t, r.master.dir, "log", "-1", "--format=%aI %cI")
+		if want := "2026-01-01T00:00:00Z 2026-01-01T00:00:00Z\n"; strings.Replace(dates, "+00:00", "Z", -1) != want {
+			t.Errorf("commit is dated %q, want %q", dates, want)
+		}
+	}
+	if heads[0] != heads[1] {
+		t.Errorf("identical commits with a fixed date have different IDs, %s and %s", heads[0], heads[1])
+	}
+}
+
+// TestCrontabReadsDuringMergesAndPulls reads the crontab over and over while commits to it are pulled,
+// and jobs merge and push commits of their own, checking that each read sees the crontab and the file it includes
+// as of the same commit. Run it with -race.
+func TestCrontabReadsDuringMergesAndPulls(t *testing.T) {
+	setUpGit(t)
+	version := func(v int) map[string]string {
+		return map[string]string{
+			"crontab": fmt.Sprintf("0 0 * * * echo crontab v%d\ninclude jobs\n", v),
+			"jobs":    fmt.Sprintf("0 0 * * * echo jobs v%d\n", v),
+		}
+	}
+	origin := newOrigin(t, version(0))
+	r := newTestRepo(t, execGit{}, origin)
+	r.rewriteMode = rewritePreserve
+	work := filepath.Join(t.TempDir(), "work")
+	runGit(t, "", "clone", "-q", origin, work)
+
+	const versions = 15
+	j := testJob(t, "* * * * * date +%s%N >> out.txt")
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		// Commit each version to origin, pulling it into the crontab clone and master.
+		defer wg.Done()
+		defer close(done)
+		for v := 1; v <= versions; v++ {
+			for name, contents := range version(v) {
+				if err := os.WriteFile(filepath.Join(work, name), []byte(contents), 0644); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if err := exec.Command("git", "-C", work, "commit", "-q", "-a", "-m", fmt.Sprintf("v%d", v)).Run(); err != nil {
+				t.Errorf("committing v%d: %s", v, err)
+				return
+			}
+			for attempt := 0; ; attempt++ {
+				// Jobs push too, so this may have to catch up with them first.
+				if err := exec.Command("git", "-C", work, "pull", "-q", "--rebase").Run(); err == nil {
+					if err := exec.Command("git", "-C", work, "push", "-q").Run(); err == nil {
+						break
+					}
+				}
+				if attempt == 5 {
+					t.Errorf("couldn't push v%d", v)
+					return
+				}
+			}
+			if err := r.crontab.FetchHead(); err != nil {
+				t.Errorf("pulling v%d into the crontab clone: %s", v, err)
+			}
+			if err := pullMaster(r); err != nil {
+				t.Errorf("pulling v%d into master: %s", v, err)
+			}
+		}
+	}()
+	go func() {
+		// Run jobs, merging their commits into master and pushing them.
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			executeCommand(&EventBus{}, j, r, time.Now(), triggerSchedule, nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		m := NewManager(0)
+		queue := newCrontabQueue()
+		for reads := 0; ; reads++ {
+			select {
+			case <-done:
+				if reads == 0 {
+					t.Error("never read the crontab")
+				}
+				return
+			default:
+			}
+			if err := readCrontab(m, r, queue); err != nil {
+				t.Errorf("reading the crontab: %s", err)
+				continue
+			}
+			entries := <-queue.updates
+			if len(entries) != 2 {
+				t.Errorf("read %d entries, want 2: %v", len(entries), entries)
+				continue
+			}
+			crontabVersion := strings.TrimPrefix(entries[0].Command, "echo crontab ")
+			jobsVersion := strings.TrimPrefix(entries[1].Command, "echo jobs ")
+			if crontabVersion != jobsVersion {
+				t.Errorf("read crontab %s with jobs %s", crontabVersion, jobsVersion)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if err := readCrontab(NewManager(0), r, newCrontabQueue()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := originFile(t, filepath.Join(r.crontab.dir, ".git"), "HEAD", "jobs"), version(versions)["jobs"]; got != want {
+		t.Errorf("crontab clone has jobs %q after pulling, want %q", got, want)
+	}
+}
+
+// setPushAllowBranches sets -push_allow_branches for the rest of the test.
+func setPushAllowBranches(t *testing.T, value string) {
+	t.Helper()
+	saved := *pushAllowBranches
+	t.Cleanup(func() {
+		*pushAllowBranches = saved
+		publishSettings()
+	})
+	*pushAllowBranches = value
+	publishSettings()
+}
+
+func TestCheckPushAllowed(t *testing.T) {
+	for _, test := range []struct {
+		allowed, branch string
+		ok              bool
+	}{
+		{"", "master", true},
+		{"", "release", true},
+		{"master", "master", true},
+		{"master", "main", false},
+		{"main,master", "master", true},
+		{"main, master", "master", true},
+		{"crony/failed/*", "crony/failed/report/20260101T000000Z", false},
+		{"crony/failed/*/*", "crony/failed/report/20260101T000000Z", true},
+		{"release-*", "release-1.2", true},
+		{"release-*", "release", false},
+		{"master", "master2", false},
+	} {
+		setPushAllowBranches(t, test.allowed)
+		err := checkPushAllowed(test.branch)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("with -push_allow_branches=%q, checkPushAllowed(%q) = %v, want allowed=%t", test.allowed, test.branch, err, test.ok)
+		}
+		if err != nil && !errors.Is(err, errPushNotAllowed) {
+			t.Errorf("with -push_allow_branches=%q, checkPushAllowed(%q) = %v, want errPushNotAllowed", test.allowed, test.branch, err)
+		}
+	}
+}
+
+func TestPushOnlyToAllowedBranches(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+	before := runGit(t, origin, "rev-parse", "master")
+
+	setPushAllowBranches(t, "main,release-*")
+	result := executeCommand(&EventBus{}, testJob(t, "* * * * * echo 1 > out.txt"), r, time.Now(), triggerSchedule, nil)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if after := runGit(t, origin, "rev-parse", "master"); after != before {
+		t.Errorf("pushed to master, which -push_allow_branches doesn't allow")
+	}
+	if got := originFile(t, filepath.Join(r.master.dir, ".git"), "master", "out.txt"); got != "1\n" {
+		t.Errorf("out.txt in the local master is %q after a refused push, want the commit kept", got)
+	}
+	if err := r.master.Push(); !errors.Is(err, errPushNotAllowed) {
+		t.Errorf("Push() = %v, want errPushNotAllowed", err)
+	}
+
+	setPushAllowBranches(t, "main,mast*")
+	if err := r.master.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if got := originFile(t, origin, "master", "out.txt"); got != "1\n" {
+		t.Errorf("out.txt in origin is %q after pushing to an allowed branch, want the kept commit", got)
+	}
+}
@@ -2,6 +2,7 @@
 set -e
 
 cd "$(dirname "$0")/.."
+hack="$(pwd)/hack"
 
 rm -fr vendor
 mkdir -p vendor/src
@@ -11,9 +12,11 @@ function get_path() {
   echo "${1#*://}"
 }
 
+# Clones url at rev, then applies patch, if given, for changes not yet upstream.
 function git_clone() {
   local url="$1"
   local rev="$2"
+  local patch="$3"
   local path="$(get_path "${url}")"
 
   echo "Cloning ${url} ${rev} to ${path}"
@@ -23,11 +26,18 @@ function git_clone() {
     cd "${path}"
     git checkout -q "${rev}"
     git fsck
+    if [ -n "${patch}" ]; then
+      echo "Applying ${patch}"
+      git apply "${patch}"
+    fi
     rm -rf .git
   )
 }
 
 git_clone https://github.com/golang/glog 20cea4dfef0c0151bba0422a6244cc1d3e8292b1
-git_clone https://github.com/kevinwallace/crontab cb0c8ebeb8bc47a9ef819de83964e72b0cd48e69
+# crontab.patch holds crony's changes to crontab on top of this revision, until they're upstream and the pin moves past them.
+# To regenerate it after changing vendor/src/github.com/kevinwallace/crontab, copy its files over a clone at this revision,
+# and run git diff there.
+git_clone https://github.com/kevinwallace/crontab cb0c8ebeb8bc47a9ef819de83964e72b0cd48e69 "${hack}/crontab.patch"
 git_clone https://github.com/kevinwallace/fieldsn 5d1f8e322e23b05814b8d2de7571d00d32d9d8cd
 
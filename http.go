@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	httpAddr = flag.String("http", "",
+		"Address on which to serve status over HTTP, e.g. \":8080\"; disabled if empty")
+)
+
+type nextRun struct {
+	Repo    string     `json:"repo"`
+	Command string     `json:"command"`
+	NextRun *time.Time `json:"next_run,omitempty"`
+	Tags    []string   `json:"tags,omitempty"`
+	// Every fire time within the requested window, if one was.
+	Upcoming []time.Time `json:"upcoming,omitempty"`
+}
+
+// nextRuns computes the next fire time after now of every job in crontabs, ordered by repo then crontab order,
+// along with every fire time in the following window, if it's positive.
+// If tag isn't empty, only jobs tagged with it are included.
+// Jobs that will never fire again have no NextRun.
+func nextRuns(crontabs map[string][]job, now time.Time, window time.Duration, tag string) []nextRun {
+	var runs []nextRun
+	var names []string
+	for name := range crontabs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, j := range crontabs[name] {
+			if tag != "" && !j.hasTag(tag) {
+				continue
+			}
+			run := nextRun{Repo: name, Command: j.Command, Tags: j.tags}
+			if next := j.Schedule.Next(now); !next.IsZero() {
+				run.NextRun = &next
+			}
+			if window > 0 {
+				run.Upcoming = j.Schedule.UpcomingWithin(now, window)
+			}
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// Serve the next fire time of every job m has scheduled as JSON, or only those with the tag given by the "tag" query parameter,
+// along with every fire time within the duration given by the "within" query parameter, if any.
+func handleNext(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var window time.Duration
+		if within := r.FormValue("within"); within != "" {
+			var err error
+			if window, err = time.ParseDuration(within); err != nil {
+				http.Error(w, "invalid within: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, nextRuns(m.scheduledJobs(), m.Clock.Now(), window, r.FormValue("tag")))
+	}
+}
+
+// Serve the status of each of m's repos as JSON, listing only jobs with the tag given by the "tag" query parameter, if any.
+func handleStatus(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Status(r.FormValue("tag")))
+	}
+}
+
+// Pause or resume a repo, as given by the "repo" query parameter, or every repo if it's missing,
+// or just the jobs in it with the tag given by the "tag" query parameter, if any.
+// Responds with the resulting status of each repo.
+func handlePause(m *Manager, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		name, tag := r.FormValue("repo"), r.FormValue("tag")
+		setPaused := m.ResumeTag
+		if paused {
+			setPaused = m.PauseTag
+		}
+		if err := setPaused(name, tag); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if name == "" {
+			name = "all repos"
+		}
+		if tag != "" {
+			name = tag + " in " + name
+		}
+		glog.Infof("paused=%t for %s", paused, name)
+		writeJSON(w, m.Status(""))
+	}
+}
+
+// runResponse describes the result of a run triggered by POST /run.
+type runResponse struct {
+	Command string    `json:"command"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Outcome Outcome   `json:"outcome"`
+	Changed bool      `json:"changed"`
+	Error   string    `json:"error,omitempty"`
+	// Branch the failed run was kept on, with -keep_failed_branches, if it was.
+	KeptBranch string `json:"kept_branch,omitempty"`
+}
+
+// Run a job right away, outside of its schedule, and respond with its result once it's done.
+// The job is the one whose name is given by the "name" query parameter, if any, or else whose command contains
+// the "command" query parameter, in the repo given by the "repo" query parameter, or any repo if it's missing.
+func handleRun(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		name, command := r.FormValue("name"), r.FormValue("command")
+		if name == "" && command == "" {
+			http.Error(w, "give a job's name or part of its command", http.StatusBadRequest)
+			return
+		}
+		result, err := m.RunNow(r.FormValue("repo"), name, command)
+		switch {
+		case err == errNoSuchJob:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err == errAlreadyRunning:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err == errShuttingDown:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := runResponse{
+			Command:    result.Command,
+			Start:      result.Start,
+			End:        result.End,
+			Outcome:    result.Outcome(),
+			Changed:    result.Changed,
+			KeptBranch: result.KeptBranch,
+		}
+		if result.Err != nil {
+			response.Error = redact(result.Err.Error())
+		}
+		writeJSON(w, response)
+	}
+}
+
+// Re-read -config, applying changes to reloadable flags, then respond with the resulting status of each repo.
+func handleReload(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, m.Status(""))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("error writing HTTP response: %s", err)
+	}
+}
+
+// Start serving m's status over HTTP in the background, if enabled by -http.
+func serveHTTP(m *Manager) {
+	if *httpAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/next", handleNext(m))
+	mux.HandleFunc("/status", handleStatus(m))
+	mux.HandleFunc("/pause", handlePause(m, true))
+	mux.HandleFunc("/resume", handlePause(m, false))
+	mux.HandleFunc("/reload", handleReload(m))
+	mux.HandleFunc("/run", handleRun(m))
+	go func() {
+		glog.Fatal(http.ListenAndServe(*httpAddr, mux))
+	}()
+}
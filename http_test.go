@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleNext(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "30 9 * * 1-5 ./weekday-report\n0 0 1 * * ./monthly\n"})
+	m := NewManager(0)
+	if err := m.Add(RepoConfig{Origin: origin}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Shutdown)
+	waitLoaded(t, m, origin)
+
+	// A Thursday.
+	now := time.Date(2026, time.October, 15, 12, 0, 0, 0, time.UTC)
+	runs := nextRuns(m.scheduledJobs(), now, 0, "")
+	want := []struct {
+		command string
+		next    time.Time
+	}{
+		{"./weekday-report", time.Date(2026, time.October, 16, 9, 30, 0, 0, time.UTC)},
+		{"./monthly", time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if len(runs) != len(want) {
+		t.Fatalf("listed %d runs, want %d: %+v", len(runs), len(want), runs)
+	}
+	for i, run := range runs {
+		if run.Repo != origin || run.Command != want[i].command || run.NextRun == nil || !run.NextRun.Equal(want[i].next) {
+			t.Errorf("listed %s in %s next at %v, want %s in %s next at %s",
+				run.Command, run.Repo, run.NextRun, want[i].command, origin, want[i].next)
+		}
+	}
+
+	server := httptest.NewServer(handleNext(m))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /next: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].Command != "./weekday-report" || runs[0].NextRun == nil {
+		t.Errorf("GET /next = %+v, want both runs, with when each is next", runs)
+	}
+
+	// Friday's run, then none over the weekend.
+	runs = nextRuns(m.scheduledJobs(), now, 72*time.Hour, "")
+	if len(runs) != 2 || len(runs[0].Upcoming) != 1 || len(runs[1].Upcoming) != 0 {
+		t.Fatalf("listed %+v within 72h, want one upcoming run of ./weekday-report, and none of ./monthly", runs)
+	}
+	if got := runs[0].Upcoming[0]; !got.Equal(want[0].next) {
+		t.Errorf("upcoming run of ./weekday-report is at %s, want %s", got, want[0].next)
+	}
+
+	resp, err = http.Get(server.URL + "?within=soon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /next?within=soon: %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+}
+
+func TestHandlePause(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	executor := &recordingExecutor{}
+	m, r := newTestManager(t, execGit{}, executor, &fakeClock{now: time.Now()}, origin)
+	j := testJob(t, "* * * * * ./poll")
+	post := func(handler http.HandlerFunc, query string) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/"+query, nil))
+		return rec.Code
+	}
+
+	if code := post(handlePause(m, true), ""); code != http.StatusOK {
+		t.Fatalf("POST /pause: %d", code)
+	}
+	m.runJob(r, j, time.Now(), triggerSchedule)
+	if n := len(executor.recorded()); n != 0 {
+		t.Errorf("ran %d times while paused, want 0", n)
+	}
+	if statuses := m.Status(""); len(statuses) != 1 || !statuses[0].Paused {
+		t.Errorf("status is %+v while paused, want paused", statuses)
+	}
+
+	if code := post(handlePause(m, false), ""); code != http.StatusOK {
+		t.Fatalf("POST /resume: %d", code)
+	}
+	m.runJob(r, j, time.Now(), triggerSchedule)
+	if n := len(executor.recorded()); n != 1 {
+		t.Errorf("ran %d times after resuming, want 1", n)
+	}
+
+	if code := post(handlePause(m, true), "?repo=no-such-repo"); code != http.StatusNotFound {
+		t.Errorf("pausing a repo that doesn't exist gave %d, want %d", code, http.StatusNotFound)
+	}
+	rec := httptest.NewRecorder()
+	handlePause(m, true)(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause gave %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleRun(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 0 1 1 * ./report --daily\n0 0 1 1 * ./cleanup\n"})
+	executor := &recordingExecutor{output: "reported\n"}
+	m, _ := newTestManager(t, execGit{}, executor, &fakeClock{now: time.Now()}, origin)
+	waitLoaded(t, m, origin)
+	post := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleRun(m)(rec, httptest.NewRequest("POST", "/run"+query, nil))
+		return rec
+	}
+
+	rec := post("?command=report")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /run?command=report: %d %s", rec.Code, rec.Body)
+	}
+	var response runResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Command != "./report --daily" || response.Outcome != OutcomeCommitted || !response.Changed || response.Error != "" {
+		t.Errorf("POST /run?command=report responded %+v, want a committed run of ./report --daily", response)
+	}
+	if executions := executor.recorded(); len(executions) != 1 || executions[0].command != "./report --daily" {
+		t.Errorf("executed %v, want just ./report --daily", executions)
+	}
+
+	if code := post("?command=no-such-command").Code; code != http.StatusNotFound {
+		t.Errorf("running a job that doesn't exist gave %d, want %d", code, http.StatusNotFound)
+	}
+	for _, j := range m.scheduledJobs()[origin] {
+		if j.Command == "./cleanup" {
+			m.mu.Lock()
+			m.repos[origin].busy[j.key()]++
+			m.mu.Unlock()
+		}
+	}
+	if code := post("?command=cleanup").Code; code != http.StatusConflict {
+		t.Errorf("running a job that's already running gave %d, want %d", code, http.StatusConflict)
+	}
+	if n := len(executor.recorded()); n != 1 {
+		t.Errorf("executed %d times, want only the first run", n)
+	}
+	rec = httptest.NewRecorder()
+	handleRun(m)(rec, httptest.NewRequest("GET", "/run?command=report", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /run gave %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
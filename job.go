@@ -0,0 +1,631 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kevinwallace/crontab"
+)
+
+// job is a crontab entry along with crony's interpretation of its options,
+// which are given in a "# crony: key=value ..." line preceding the entry:
+//
+//	output_file=<path>  write the command's output to path in the repo, overwriting it each run;
+//	                    if path is empty, it defaults to outputs/<command>.log
+//	skip_unchanged_output
+//	                    don't commit a successful run whose output matches the output file's last
+//	                    committed contents, even if the command changed other files; needs output_file
+//	output_notes        attach the command's output to its commit as a git note, rather than putting it
+//	                    in the commit message
+//	run_on_start        also run the command as soon as the entry is first loaded
+//	success_exit_codes=<code>,...
+//	                    exit codes which count as success, rather than only 0
+//	name=<name>         name by which other entries in the crontab can refer to this one
+//	after=<name>        only run if the most recent run of the named entry succeeded
+//	tags=<tag>,...      tags by which the entry can be paused, resumed, and looked up along with others
+//	lock=<name>         don't run at the same time as any other entry, in any repo, with the same lock
+//	failure_cooldown=<duration>
+//	                    after a failed run, skip scheduled runs until the duration has passed
+//	window=<start>-<end>
+//	                    skip scheduled runs outside the given times of day, e.g. 09:00-17:00, or 22:00-02:00
+//	                    across midnight, including the start but not the end
+//	window_days=<days>  only open the window on the given days of the week, e.g. mon-fri, as in a schedule
+//	timeout=<duration>  terminate the command if it's still running after the duration
+//	deadline=next       terminate the command if it's still running when it would have to be killed
+//	                    to finish before the entry's next scheduled run, less deadline_margin=<duration>
+//	nice=<n>            run the command at the given niceness, from -20 to 19
+//	ionice=<class>[:<level>]
+//	                    run the command in the given IO scheduling class (idle, best-effort, or realtime),
+//	                    at the given priority level within it, from 0 to 7
+//	memory_limit=<size> limit the command's virtual memory, in bytes or with a K, M, or G suffix
+//	cpu_limit=<duration>
+//	                    limit the CPU time the command may use, to the second
+//	max_processes=<n>   limit the processes the command's user may have at once, counting all of
+//	                    theirs, not just the command's
+//	commit=<mode>       which changes to commit: "all" of them (the default), only those to files
+//	                    already "tracked", or only those to a comma-separated list of paths
+//	produces=<glob>,...
+//	                    warn if a successful run doesn't change any file matching one of the globs
+//	summarize_changes   if the command prints nothing, list the files it changed in the commit message instead
+//	skip_first          don't publish events for the entry's first run since crony started, which only
+//	                    establishes a baseline; it still runs and commits as usual
+//	require_clean_after fail a run that changes any file other than those matching produces or the output
+//	                    file, committing none of its changes
+//	runner=<runner>     run the command directly in a "shell" (the default), with "exec", without a shell,
+//	                    or with "docker:<image>", in a container of the given image with the workdir
+//	                    mounted at the same path
+//	commit_date=<date>  date each run's commit: "scheduled" for the time the run was scheduled for,
+//	                    or a fixed RFC 3339 time, so that runs making the same changes make the same commit
+//
+// In a system crontab, the command runs as the entry's user.
+type job struct {
+	crontab.Entry
+	// User and group to run the command as, if the entry has a user.
+	credential *syscall.Credential
+	// Path relative to the repo root to which the command's output is written each run, if any.
+	outputFile string
+	// Whether to skip committing successful runs that leave the output file unchanged.
+	skipUnchangedOutput bool
+	// Whether to attach the command's output to its commit as a note, rather than including it in the message.
+	outputNotes bool
+	// Whether to run as soon as the entry is first loaded, in addition to its schedule.
+	runOnStart bool
+	// Exit codes which count as success; if empty, only 0 does.
+	successExitCodes []int
+	// Name by which other jobs in the same crontab can refer to this one, if any.
+	name string
+	// Name of the job whose most recent run must have succeeded for this one to run, if any.
+	after string
+	// Tags grouping this job with others, for pausing and filtering.
+	tags []string
+	// Name of the lock held while running, shared across all repos, if any.
+	lock string
+	// How long to skip scheduled runs after a failed run, if at all.
+	failureCooldown time.Duration
+	// When scheduled runs may happen, if not at any time.
+	window *timeWindow
+	// How long the command may run before it's terminated, if limited.
+	timeout time.Duration
+	// Whether the command must be killed before the entry's next run, and by how long before.
+	deadlineNext   bool
+	deadlineMargin time.Duration
+	// Niceness to run the command at; 0 leaves it unchanged.
+	nice int
+	// IO scheduling class and priority level within it to run the command with, if set.
+	ioniceClass, ioniceLevel string
+	// Limits on the command's virtual memory in KiB, and CPU time in seconds, if positive.
+	memoryLimit, cpuLimit int64
+	// Limit on the processes the command's user may have, if positive.
+	maxProcesses int
+	// Which of the command's changes to commit.
+	commitMode commitMode
+	// Docker image in which to run the command, if it's not run directly.
+	dockerImage string
+	// Whether to run the command without a shell, splitting it into arguments and expanding variables in each.
+	execRunner bool
+	// Globs matching files the command is expected to change, if declared.
+	produces []string
+	// Whether changing any other file, besides the output file, fails the run.
+	requireCleanAfter bool
+	// Whether to publish no events for the first run.
+	skipFirst bool
+	// Whether to list the files the command changed in the commit message, if it prints nothing.
+	summarizeChanges bool
+	// Fixed date to give each run's commit, or whether to date it when the run was scheduled for, if either.
+	commitDate          time.Time
+	commitDateScheduled bool
+}
+
+// knownOptions are the options newJob interprets.
+var knownOptions = map[string]bool{
+	"output_file":           true,
+	"skip_unchanged_output": true,
+	"output_notes":          true,
+	"run_on_start":          true,
+	"success_exit_codes":    true,
+	"name":                  true,
+	"after":                 true,
+	"tags":                  true,
+	"lock":                  true,
+	"failure_cooldown":      true,
+	"window":                true,
+	"window_days":           true,
+	"timeout":               true,
+	"deadline":              true,
+	"deadline_margin":       true,
+	"nice":                  true,
+	"ionice":                true,
+	"memory_limit":          true,
+	"cpu_limit":             true,
+	"max_processes":         true,
+	"commit":                true,
+	"runner":                true,
+	"produces":              true,
+	"commit_date":           true,
+	"require_clean_after":   true,
+	"skip_first":            true,
+	"summarize_changes":     true,
+}
+
+// newJob interprets entry's options, warning about any it doesn't know.
+func newJob(entry crontab.Entry) (job, error) {
+	j := job{Entry: entry}
+	for key := range entry.Options {
+		if !knownOptions[key] {
+			glog.Warningf("ignoring unknown option %q for %s", key, entry.Command)
+		}
+	}
+	if entry.User != "" {
+		var err error
+		if j.credential, err = lookupCredential(entry.User); err != nil {
+			return job{}, err
+		}
+	}
+	if outputFile, ok := entry.Options["output_file"]; ok {
+		if outputFile == "" {
+			outputFile = "outputs/" + slugify(entry.Command) + ".log"
+		}
+		outputFile = filepath.Clean(outputFile)
+		if filepath.IsAbs(outputFile) || outputFile == ".." || strings.HasPrefix(outputFile, "../") {
+			return job{}, fmt.Errorf("output_file must be within the repo: %s", outputFile)
+		}
+		j.outputFile = outputFile
+	}
+	var err error
+	if j.skipUnchangedOutput, err = boolOption(entry.Options, "skip_unchanged_output"); err != nil {
+		return job{}, err
+	}
+	if j.skipUnchangedOutput && j.outputFile == "" {
+		return job{}, fmt.Errorf("skip_unchanged_output needs output_file")
+	}
+	if j.outputNotes, err = boolOption(entry.Options, "output_notes"); err != nil {
+		return job{}, err
+	}
+	if j.runOnStart, err = boolOption(entry.Options, "run_on_start"); err != nil {
+		return job{}, err
+	}
+	if codes, ok := entry.Options["success_exit_codes"]; ok {
+		for _, code := range strings.Split(codes, ",") {
+			n, err := strconv.Atoi(code)
+			if err != nil {
+				return job{}, fmt.Errorf("success_exit_codes must be a list of integers: %s", codes)
+			}
+			j.successExitCodes = append(j.successExitCodes, n)
+		}
+	}
+	j.name = entry.Options["name"]
+	j.after = entry.Options["after"]
+	if tags, ok := entry.Options["tags"]; ok {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag == "" {
+				return job{}, fmt.Errorf("tags must be a comma-separated list of non-empty tags: %s", tags)
+			}
+			j.tags = append(j.tags, tag)
+		}
+	}
+	j.lock = entry.Options["lock"]
+	if j.failureCooldown, err = durationOption(entry.Options, "failure_cooldown"); err != nil {
+		return job{}, err
+	}
+	if window, ok := entry.Options["window"]; ok {
+		if j.window, err = parseWindow(window, entry.Options["window_days"]); err != nil {
+			return job{}, err
+		}
+	} else if _, ok := entry.Options["window_days"]; ok {
+		return job{}, fmt.Errorf("window_days needs a window")
+	}
+	if j.timeout, err = durationOption(entry.Options, "timeout"); err != nil {
+		return job{}, err
+	}
+	if deadline, ok := entry.Options["deadline"]; ok {
+		if deadline != "next" {
+			return job{}, fmt.Errorf("deadline must be next: %s", deadline)
+		}
+		j.deadlineNext = true
+	}
+	if j.deadlineMargin, err = durationOption(entry.Options, "deadline_margin"); err != nil {
+		return job{}, err
+	}
+	if nice, ok := entry.Options["nice"]; ok {
+		n, err := strconv.Atoi(nice)
+		if err != nil || n < -20 || n > 19 {
+			return job{}, fmt.Errorf("nice must be an integer from -20 to 19: %s", nice)
+		}
+		j.nice = n
+	}
+	if ionice, ok := entry.Options["ionice"]; ok {
+		classLevel := strings.SplitN(ionice, ":", 2)
+		switch classLevel[0] {
+		case "idle", "best-effort", "realtime":
+		default:
+			return job{}, fmt.Errorf("ionice class must be idle, best-effort, or realtime: %s", ionice)
+		}
+		j.ioniceClass = classLevel[0]
+		if len(classLevel) == 2 {
+			if n, err := strconv.Atoi(classLevel[1]); err != nil || n < 0 || n > 7 {
+				return job{}, fmt.Errorf("ionice level must be an integer from 0 to 7: %s", ionice)
+			}
+			j.ioniceLevel = classLevel[1]
+		}
+	}
+	if limit, ok := entry.Options["memory_limit"]; ok {
+		bytes, err := parseSize(limit)
+		if err != nil || bytes < 1024 {
+			return job{}, fmt.Errorf("memory_limit must be a size of at least 1K, e.g. 512M: %s", limit)
+		}
+		j.memoryLimit = bytes / 1024
+	}
+	cpuLimit, err := durationOption(entry.Options, "cpu_limit")
+	if err != nil {
+		return job{}, err
+	}
+	j.cpuLimit = int64((cpuLimit + time.Second - 1) / time.Second)
+	if max, ok := entry.Options["max_processes"]; ok {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 1 {
+			return job{}, fmt.Errorf("max_processes must be a positive integer: %s", max)
+		}
+		j.maxProcesses = n
+	}
+	if j.commitMode, err = parseCommitMode(entry.Options["commit"]); err != nil {
+		return job{}, err
+	}
+	if runner, ok := entry.Options["runner"]; ok {
+		switch {
+		case runner == "shell":
+		case runner == "exec":
+			if len(strings.Fields(entry.Command)) == 0 {
+				return job{}, fmt.Errorf("runner=exec needs a command")
+			}
+			j.execRunner = true
+		case strings.HasPrefix(runner, "docker:") && runner != "docker:":
+			j.dockerImage = strings.TrimPrefix(runner, "docker:")
+		default:
+			return job{}, fmt.Errorf("runner must be shell, exec, or docker:<image>: %s", runner)
+		}
+	}
+	if produces, ok := entry.Options["produces"]; ok {
+		for _, glob := range strings.Split(produces, ",") {
+			if _, err := filepath.Match(glob, ""); err != nil || glob == "" {
+				return job{}, fmt.Errorf("produces must be a list of globs: %s", produces)
+			}
+			j.produces = append(j.produces, glob)
+		}
+	}
+	if j.requireCleanAfter, err = boolOption(entry.Options, "require_clean_after"); err != nil {
+		return job{}, err
+	}
+	if j.skipFirst, err = boolOption(entry.Options, "skip_first"); err != nil {
+		return job{}, err
+	}
+	if j.summarizeChanges, err = boolOption(entry.Options, "summarize_changes"); err != nil {
+		return job{}, err
+	}
+	if date, ok := entry.Options["commit_date"]; ok {
+		if date == "scheduled" {
+			j.commitDateScheduled = true
+		} else if j.commitDate, err = time.Parse(time.RFC3339, date); err != nil {
+			return job{}, fmt.Errorf("commit_date must be scheduled or an RFC 3339 time, e.g. 2026-01-01T00:00:00Z: %s", date)
+		}
+	}
+	if j.after != "" && j.after == j.name {
+		return job{}, fmt.Errorf("can't run after itself")
+	}
+	return j, nil
+}
+
+// lookupCredential returns the credential with which to run commands as the named user, in its primary group.
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has non-numeric uid %s", name, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has non-numeric gid %s", name, u.Gid)
+	}
+	if os.Getuid() != 0 && int(uid) != os.Getuid() {
+		return nil, fmt.Errorf("can't run commands as %s unless crony runs as root", name)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// hasTag reports whether the job is tagged with tag.
+func (j job) hasTag(tag string) bool {
+	for _, t := range j.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// key identifies the job's entry, telling it apart from other entries with the same command
+// but a different schedule, user, file, or options.
+func (j job) key() string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%v", j.File, j.User, j.Schedule.Cron(), j.Options, j.Command)
+}
+
+// commandArgs returns the arguments with which to run the job's command in dir,
+// running it under nice, ionice, and ulimit as its options require, all within a container if it has a docker runner,
+// into which the variables set in env are passed.
+func (j job) commandArgs(dir string, env []string) []string {
+	args := []string{"/bin/bash", "-c", j.Command}
+	if j.execRunner {
+		args = j.execArgs(env)
+	}
+	var limits []string
+	if j.memoryLimit > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", j.memoryLimit))
+	}
+	if j.cpuLimit > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", j.cpuLimit))
+	}
+	if j.maxProcesses > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -u %d", j.maxProcesses))
+	}
+	if len(limits) > 0 && j.execRunner {
+		// The wrapping shell is passed the arguments as $@, after a placeholder $0.
+		args = append([]string{"/bin/bash", "-c", strings.Join(limits, " && ") + ` && exec "$@"`, "bash"}, args...)
+	} else if len(limits) > 0 {
+		// The wrapping shell is passed the command as $0, so it needn't be quoted.
+		args = []string{"/bin/bash", "-c", strings.Join(limits, " && ") + ` && exec /bin/bash -c "$0"`, j.Command}
+	}
+	if j.ioniceClass != "" {
+		ionice := []string{"ionice", "-c", j.ioniceClass}
+		if j.ioniceLevel != "" {
+			ionice = append(ionice, "-n", j.ioniceLevel)
+		}
+		args = append(ionice, args...)
+	}
+	if j.nice != 0 {
+		args = append([]string{"nice", "-n", strconv.Itoa(j.nice)}, args...)
+	}
+	if j.dockerImage != "" {
+		// Run as crony's own user, so that files the command writes can be committed and cleaned up,
+		// unless the entry has a user of its own.
+		uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+		if j.credential != nil {
+			uid, gid = j.credential.Uid, j.credential.Gid
+		}
+		docker := []string{"docker", "run", "--rm",
+			"--user", fmt.Sprintf("%d:%d", uid, gid),
+			"--volume", dir + ":" + dir, "--workdir", dir}
+		for _, setting := range env {
+			// Given just its name, docker passes the variable through from its own environment.
+			docker = append(docker, "--env", strings.SplitN(setting, "=", 2)[0])
+		}
+		docker = append(docker, j.dockerImage)
+		args = append(docker, args...)
+	}
+	return args
+}
+
+// runTimeout returns how long a run starting at now may take before it's terminated, or 0 if it's not limited.
+// With deadline=next, that's the lesser of its timeout and however long leaves time for the command to be killed,
+// after -kill_grace_period, deadline_margin before the entry's next run; if there's no time at all, it's negative.
+func (j job) runTimeout(now time.Time) time.Duration {
+	if !j.deadlineNext {
+		return j.timeout
+	}
+	next := j.Schedule.Next(now)
+	if next.IsZero() {
+		return j.timeout
+	}
+	deadline := next.Sub(now) - settings().killGracePeriod - j.deadlineMargin
+	if deadline <= 0 {
+		return -1
+	}
+	if j.timeout > 0 && j.timeout < deadline {
+		return j.timeout
+	}
+	return deadline
+}
+
+// execArgs splits the job's command into arguments at whitespace, with no quoting, to run it without a shell,
+// then expands $NAME and ${NAME} in each argument to the variable's setting in env, a list of "NAME=value" settings,
+// or else in crony's own environment.
+func (j job) execArgs(env []string) []string {
+	settings := make(map[string]string)
+	for _, setting := range env {
+		if nameValue := strings.SplitN(setting, "=", 2); len(nameValue) == 2 {
+			settings[nameValue[0]] = nameValue[1]
+		}
+	}
+	lookup := func(name string) string {
+		if value, ok := settings[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	}
+	var args []string
+	for _, field := range strings.Fields(j.Command) {
+		args = append(args, os.Expand(field, lookup))
+	}
+	return args
+}
+
+// commitTime returns the date to give the commit of a run scheduled for scheduled, or the zero time to date it as usual.
+func (j job) commitTime(scheduled time.Time) time.Time {
+	if j.commitDateScheduled {
+		return scheduled
+	}
+	return j.commitDate
+}
+
+// producedAny determines whether any of changed, a list of paths relative to the repo root,
+// matches one of the globs of files the job is expected to produce.
+func (j job) producedAny(changed []string) bool {
+	for _, file := range changed {
+		for _, glob := range j.produces {
+			if matched, _ := filepath.Match(glob, file); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unexpectedChanges returns those of changed, a list of paths relative to the repo root,
+// that are neither the job's output file nor match one of the globs of files it's expected to produce.
+func (j job) unexpectedChanges(changed []string) []string {
+	var unexpected []string
+	for _, file := range changed {
+		if file != j.outputFile && !j.producedAny([]string{file}) {
+			unexpected = append(unexpected, file)
+		}
+	}
+	return unexpected
+}
+
+// checkDependencies returns an error for each job that has the same name as an earlier job,
+// or that must run after a job that doesn't exist, keyed by index in jobs.
+func checkDependencies(jobs []job) map[int]error {
+	errs := make(map[int]error)
+	names := make(map[string]bool)
+	for i, j := range jobs {
+		if j.name == "" {
+			continue
+		}
+		if names[j.name] {
+			errs[i] = fmt.Errorf("another entry is already named %s", j.name)
+		}
+		names[j.name] = true
+	}
+	for i, j := range jobs {
+		if j.after != "" && !names[j.after] {
+			errs[i] = fmt.Errorf("no entry named %s to run after", j.after)
+		}
+	}
+	return errs
+}
+
+// succeeded determines whether the job's command exiting with code counts as success.
+func (j job) succeeded(code int) bool {
+	if len(j.successExitCodes) == 0 {
+		return code == 0
+	}
+	for _, c := range j.successExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// boolOption interprets the named option as a bool, which is true if it's given without a value.
+func boolOption(options map[string]string, name string) (bool, error) {
+	value, ok := options[name]
+	if !ok {
+		return false, nil
+	}
+	if value == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false: %s", name, value)
+	}
+	return b, nil
+}
+
+var nonSlugChars = regexp.MustCompile("[^a-z0-9]+")
+
+// durationOption parses the named option as a positive duration, returning 0 if it's not set.
+func durationOption(options map[string]string, name string) (time.Duration, error) {
+	value, ok := options[name]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, e.g. 10m: %s", name, value)
+	}
+	return d, nil
+}
+
+// parseSize parses a number of bytes, optionally with a K, M, or G suffix.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			multiplier = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// commandNotFoundExitCode is the status with which bash exits when it can't find a command.
+const commandNotFoundExitCode = 127
+
+// slugify turns a command into something usable as a filename, e.g. "./foo --bar" becomes "foo-bar".
+func slugify(command string) string {
+	slug := strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(command), "-"), "-")
+	if len(slug) > 64 {
+		slug = strings.TrimRight(slug[:64], "-")
+	}
+	if slug == "" {
+		slug = "command"
+	}
+	return slug
+}
+
+// Outcome classifies a job's run.
+type Outcome string
+
+// Possible outcomes of a job's run.
+const (
+	// The command failed, or couldn't be run.
+	OutcomeFailed Outcome = "failed"
+	// The shell couldn't find the command, which is unlikely to fix itself before the next run.
+	OutcomeCommandNotFound Outcome = "command_not_found"
+	// The command succeeded and its changes were committed.
+	OutcomeCommitted Outcome = "committed"
+	// The command succeeded without changing anything.
+	OutcomeUnchanged Outcome = "unchanged"
+)
+
+// RunResult describes a single run of a job.
+type RunResult struct {
+	Command    string
+	Start, End time.Time
+	// Why the command failed or couldn't be run, if it did.
+	Err error
+	// Whether the command failed because the shell couldn't find it.
+	CommandNotFound bool
+	// Whether the run's changes were committed; they may still have failed to be pushed.
+	Changed bool
+	// Branch the failed run was kept on, with -keep_failed_branches, if it was.
+	KeptBranch string
+}
+
+// Outcome classifies the run.
+func (r RunResult) Outcome() Outcome {
+	switch {
+	case r.Err != nil && r.CommandNotFound:
+		return OutcomeCommandNotFound
+	case r.Err != nil:
+		return OutcomeFailed
+	case r.Changed:
+		return OutcomeCommitted
+	}
+	return OutcomeUnchanged
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	outputLogDir = flag.String("output_log_dir", "",
+		"If set, append the output of every run, committed or not, to <dir>/<repo>/<command>.log, outside the repo; "+
+			"logs are rotated and cleaned up according to -output_log_max_size, -output_log_max_files, and -output_log_max_age")
+	outputLogMaxFiles = flag.Int("output_log_max_files", 5,
+		"Most rotated logs to keep for each command in -output_log_dir, besides the one being appended to")
+	outputLogMaxAge = flag.Duration("output_log_max_age", 0,
+		"If positive, delete logs in -output_log_dir last written longer ago than this")
+)
+
+var outputLogMaxSize = byteSize(10 << 20)
+
+func init() {
+	flag.Var(&outputLogMaxSize, "output_log_max_size",
+		"Size, in bytes or with a K, M, or G suffix, past which a log in -output_log_dir is rotated to <command>.log.1, "+
+			"shifting older rotations up; if not positive, logs aren't rotated")
+}
+
+// outputLogRetention is how logs in a directory of -output_log_dir are rotated and cleaned up.
+type outputLogRetention struct {
+	// Size past which a log is rotated, if positive.
+	maxSize int64
+	// Most rotated logs to keep for each command.
+	maxFiles int
+	// Age past which a log is deleted, if positive.
+	maxAge time.Duration
+}
+
+// outputLogFlags returns the retention set by the -output_log_* flags.
+func outputLogFlags() outputLogRetention {
+	return outputLogRetention{int64(outputLogMaxSize), *outputLogMaxFiles, *outputLogMaxAge}
+}
+
+// outputLogPath returns the path of the log in -output_log_dir for command's runs in the named repo.
+func outputLogPath(repo, command string) string {
+	return filepath.Join(*outputLogDir, slugify(repo), slugify(command)+".log")
+}
+
+// appendOutputLog appends the redacted output of a run of command in repo, which started at start
+// and exited with exitCode, to its log in -output_log_dir, then rotates it if it's grown too big.
+func appendOutputLog(repo *repo, command string, start time.Time, exitCode int, out []byte) error {
+	repo.logs.Lock()
+	defer repo.logs.Unlock()
+	file := outputLogPath(repo.name, command)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "=== %s (exit %d) $ %s\n%s", start.UTC().Format(time.RFC3339), exitCode, redact(command), redact(string(out)))
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		fmt.Fprintln(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return outputLogFlags().rotate(file)
+}
+
+// rotate renames the log at file to file.1 if it's bigger than r.maxSize, shifting older rotations up,
+// and deleting those beyond r.maxFiles.
+func (r outputLogRetention) rotate(file string) error {
+	if r.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() <= r.maxSize {
+		return nil
+	}
+	if r.maxFiles <= 0 {
+		return os.Remove(file)
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", file, r.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := r.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", file, n), fmt.Sprintf("%s.%d", file, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(file, file+".1")
+}
+
+// clean rotates each log in dir that's too big, and deletes those that are too old,
+// along with rotations beyond r.maxFiles, say because it was lowered since they were made.
+func (r outputLogRetention) clean(dir string, now time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var errs []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		if r.maxAge > 0 {
+			if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > r.maxAge {
+				if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+					errs = append(errs, err.Error())
+				}
+				continue
+			}
+		}
+		if strings.HasSuffix(file, ".log") {
+			if err := r.rotate(file); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if i := strings.LastIndex(file, ".log."); i >= 0 {
+			if n, err := strconv.Atoi(file[i+len(".log."):]); err == nil && n > r.maxFiles {
+				if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+					errs = append(errs, err.Error())
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Spin up a background goroutine to periodically clean up repo's logs in -output_log_dir until m shuts down.
+func retainOutputLogs(m *Manager, repo *repo) {
+	if *outputLogDir == "" {
+		return
+	}
+	dir := filepath.Join(*outputLogDir, slugify(repo.name))
+	m.goBackground(func() {
+		for {
+			repo.logs.Lock()
+			err := outputLogFlags().clean(dir, time.Now())
+			repo.logs.Unlock()
+			if err != nil {
+				glog.Errorf("error cleaning up output logs for %s: %s", repo.name, err)
+			}
+			select {
+			case <-time.After(settings().pullFrequency):
+			case <-m.stopping:
+				return
+			}
+		}
+	})
+}
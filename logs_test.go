@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeLog(t *testing.T, file string, size int, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestOutputLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "job.log")
+	r := outputLogRetention{maxSize: 10, maxFiles: 2}
+	now := time.Now()
+	writeLog(t, file, 5, now)
+	if err := r.rotate(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(listDir(t, dir), " "); got != "job.log" {
+		t.Fatalf("after rotating a log within its maximum size, logs are %s, want job.log", got)
+	}
+	for i := 0; i < 4; i++ {
+		writeLog(t, file, 20, now)
+		if err := r.rotate(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := strings.Join(listDir(t, dir), " "), "job.log.1 job.log.2"; got != want {
+		t.Errorf("after rotating 4 times, logs are %s, want %s", got, want)
+	}
+}
+
+func TestOutputLogClean(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeLog(t, filepath.Join(dir, "big.log"), 20, now)
+	writeLog(t, filepath.Join(dir, "old.log"), 1, now.Add(-48*time.Hour))
+	writeLog(t, filepath.Join(dir, "old.log.1"), 1, now.Add(-72*time.Hour))
+	writeLog(t, filepath.Join(dir, "recent.log"), 1, now)
+	writeLog(t, filepath.Join(dir, "recent.log.3"), 1, now)
+	r := outputLogRetention{maxSize: 10, maxFiles: 2, maxAge: 24 * time.Hour}
+	if err := r.clean(dir, now); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(listDir(t, dir), " "), "big.log.1 recent.log"; got != want {
+		t.Errorf("after cleaning, logs are %s, want %s", got, want)
+	}
+}
+
+func TestAppendOutputLog(t *testing.T) {
+	saved, savedSize := *outputLogDir, outputLogMaxSize
+	defer func() { *outputLogDir, outputLogMaxSize = saved, savedSize }()
+	*outputLogDir, outputLogMaxSize = t.TempDir(), 100
+
+	r := &repo{name: "git@example.com:jobs.git"}
+	start := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	if err := appendOutputLog(r, "./report.sh", start, 0, []byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	file := outputLogPath(r.name, "./report.sh")
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "=== 2026-03-01T12:00:00Z (exit 0) $ ./report.sh\ndone\n"; got != want {
+		t.Errorf("log is %q, want %q", got, want)
+	}
+	if err := appendOutputLog(r, "./report.sh", start, 1, []byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file + ".1"); err != nil {
+		t.Errorf("log past -output_log_max_size wasn't rotated: %s", err)
+	}
+}
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kevinwallace/crontab"
+)
+
+// Manager owns a set of repos, scheduling each one's crontab while sharing a limit on concurrently-running jobs.
+type Manager struct {
+	// Lifecycle events for every job the manager runs.
+	Events *EventBus
+	// Used to operate on repos added after it's set.
+	Git GitBackend
+	// Used to run the commands of jobs in repos added after it's set.
+	Executor Executor
+	// Used to schedule jobs.
+	Clock crontab.Clock
+	// If set, jobs are logged instead of run.
+	DryRun bool
+	// How often to check Clock while waiting for a job's next run, so that jobs follow it if it jumps;
+	// if zero, a minute.
+	RecheckInterval time.Duration
+
+	// Semaphore limiting the number of concurrently-running jobs across all repos; nil if unlimited.
+	slots chan struct{}
+	// Likewise for pulls from origin.
+	pullSlots chan struct{}
+	// Closed when the manager starts shutting down.
+	stopping chan struct{}
+	// Closed when running jobs should be terminated, once -shutdown_timeout has passed while shutting down.
+	terminating chan struct{}
+	// In-flight jobs, and how many there are.
+	running  sync.WaitGroup
+	inFlight int
+	// Goroutines pulling, scheduling and otherwise looking after repos, which exit once stopping is closed.
+	background sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped bool
+	// Whether jobs in every repo are paused.
+	paused bool
+	repos  map[string]*managedRepo
+	// Tags whose jobs are paused in every repo.
+	pausedTags map[string]bool
+	// Named locks shared by jobs across all repos, each held by sending to it.
+	locks map[string]chan struct{}
+	// Closed once each named repo's first crontab has been applied, for repos that start after it.
+	loaded map[string]chan struct{}
+	// When each @since_success job last succeeded, and the file they're recorded in, if any.
+	successes successes
+	stateFile string
+}
+
+// managedRepo is a repo along with the manager's bookkeeping about it.
+type managedRepo struct {
+	repo *repo
+	jobs []job
+	// Crontabs pulled but not yet applied.
+	queue *crontabQueue
+	// Entries in the most recently loaded crontab, and those of them that weren't scheduled.
+	parsed        int
+	rejected      []RejectedEntry
+	lastPull      time.Time
+	lastPullError error
+	runs          int
+	running       int
+	// Whether jobs in this repo are paused, regardless of whether every repo is.
+	paused bool
+	// Tags whose jobs are paused in this repo, in addition to those paused in every repo.
+	pausedTags map[string]bool
+	// Whether the most recent run of each named job succeeded.
+	succeeded map[string]bool
+	// Commands that have started running.
+	started map[string]bool
+	// How many runs of each entry, by key, are running now, or waiting for a slot or lock to,
+	// so that a run triggered out of schedule never overlaps another run of the same entry.
+	busy map[string]int
+	// Outcomes of each command's runs.
+	outcomes map[string]*JobStatus
+	// Branches kept for failed runs, oldest first.
+	failedBranches []FailedBranch
+}
+
+// RepoStatus summarizes what a Manager knows about one of its repos.
+type RepoStatus struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	// Entries in the most recently loaded crontab, including any that weren't scheduled.
+	Parsed        int             `json:"parsed"`
+	Rejected      []RejectedEntry `json:"rejected,omitempty"`
+	LastPull      time.Time       `json:"last_pull"`
+	LastPullError string          `json:"last_pull_error,omitempty"`
+	Runs          int             `json:"runs"`
+	Running       int             `json:"running"`
+	Paused        bool            `json:"paused"`
+	// Tags whose jobs are paused in this repo, whether just in it or in every repo, in order.
+	PausedTags []string `json:"paused_tags,omitempty"`
+	// Kind of the last pull's error, if it was a PullError.
+	LastPullErrorKind PullErrorKind `json:"last_pull_error_kind,omitempty"`
+	// Crontabs pulled but not yet applied, those superseded by newer ones before they were, and when one last was.
+	PendingCrontabs    int       `json:"pending_crontabs"`
+	SupersededCrontabs int       `json:"superseded_crontabs"`
+	LastCrontabApplied time.Time `json:"last_crontab_applied"`
+	// Outcomes of each command that has run, ordered by command.
+	Jobs []JobStatus `json:"jobs"`
+	// Branches kept for failed runs with -keep_failed_branches, oldest first.
+	FailedBranches []FailedBranch `json:"failed_branches,omitempty"`
+	// Temporary branches currently in use, ordered by branch.
+	ActiveWorkdirs []ActiveWorkdir `json:"active_workdirs,omitempty"`
+}
+
+// FailedBranch is a branch kept for a failed run.
+type FailedBranch struct {
+	Branch  string    `json:"branch"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+}
+
+// RejectedEntry is a crontab entry that wasn't scheduled, and why.
+type RejectedEntry struct {
+	Command string `json:"command"`
+	Reason  string `json:"reason"`
+}
+
+// JobStatus counts the outcomes of a command's runs.
+type JobStatus struct {
+	Command   string `json:"command"`
+	Committed int    `json:"committed"`
+	Unchanged int    `json:"unchanged"`
+	Failed    int    `json:"failed"`
+	// Failed runs where the shell couldn't find the command, which aren't counted in Failed.
+	CommandNotFound int     `json:"command_not_found"`
+	LastOutcome     Outcome `json:"last_outcome"`
+	// Whether the most recent run's changes were committed.
+	LastChanged bool `json:"last_changed"`
+	// Until when scheduled runs are skipped after a failure, if the command has a failure_cooldown.
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+}
+
+// NewManager creates a Manager that runs at most maxConcurrentJobs jobs at once, or any number if it's not positive.
+func NewManager(maxConcurrentJobs int) *Manager {
+	m := &Manager{
+		Events:      &EventBus{},
+		Git:         execGit{},
+		Executor:    shellExecutor{},
+		Clock:       realClock{},
+		stopping:    make(chan struct{}),
+		terminating: make(chan struct{}),
+		repos:       make(map[string]*managedRepo),
+		pausedTags:  make(map[string]bool),
+		locks:       make(map[string]chan struct{}),
+		loaded:      make(map[string]chan struct{}),
+		successes:   make(successes),
+	}
+	if maxConcurrentJobs > 0 {
+		m.slots = make(chan struct{}, maxConcurrentJobs)
+	}
+	return m
+}
+
+// SetMaxConcurrentJobs changes the limit on concurrently-running jobs to n, or removes it if n isn't positive.
+// Jobs already running or waiting for a slot count against the old limit, not the new one.
+func (m *Manager) SetMaxConcurrentJobs(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > 0 && m.slots != nil && cap(m.slots) == n {
+		return
+	}
+	m.slots = nil
+	if n > 0 {
+		m.slots = make(chan struct{}, n)
+	}
+}
+
+// SetMaxConcurrentPulls changes the limit on concurrent pulls from origin across all repos to n,
+// or removes it if n isn't positive. Pulls already running or waiting count against the old limit, not the new one.
+func (m *Manager) SetMaxConcurrentPulls(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > 0 && m.pullSlots != nil && cap(m.pullSlots) == n {
+		return
+	}
+	m.pullSlots = nil
+	if n > 0 {
+		m.pullSlots = make(chan struct{}, n)
+	}
+}
+
+// pullSlot waits for there to be room under the limit on concurrent pulls, returning a function to call
+// once the pull is done, or false if the manager started shutting down first.
+func (m *Manager) pullSlot() (func(), bool) {
+	m.mu.Lock()
+	slots := m.pullSlots
+	m.mu.Unlock()
+	if slots == nil {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		// Release the slot taken, even if the limit has since changed.
+		return func() { <-slots }, true
+	case <-m.stopping:
+		return nil, false
+	}
+}
+
+// Add clones the remote repo c describes and starts scheduling its crontab.
+func (m *Manager) Add(c RepoConfig) error {
+	name := c.name()
+	m.mu.Lock()
+	_, exists := m.repos[name]
+	m.mu.Unlock()
+	if exists {
+		return fmt.Errorf("already managing a repo named %s", name)
+	}
+
+	pullMode, err := parsePullMode(*pullModeName)
+	if err != nil {
+		return err
+	}
+	rewriteMode, err := parseRewriteMode(*historyRewriteName)
+	if err != nil {
+		return err
+	}
+	git := m.Git
+	if c.SSHKey != "" {
+		g, ok := git.(execGit)
+		if !ok {
+			return fmt.Errorf("an ssh_key can only be used with the default git backend")
+		}
+		// The shell git runs ssh with expands the key's path, so that it needn't be quoted.
+		g.env = append(g.env[:len(g.env):len(g.env)],
+			"CRONY_SSH_KEY="+c.SSHKey, `GIT_SSH_COMMAND=ssh -o IdentitiesOnly=yes -i "$CRONY_SSH_KEY"`)
+		git = g
+	}
+	r, err := NewClone(git, name, append([]string{c.Origin}, c.Mirrors...))
+	if err != nil {
+		return err
+	}
+	r.executor = m.Executor
+	r.mergeStrategyOption = *mergeStrategyOption
+	r.pullMode = pullMode
+	r.rewriteMode = rewriteMode
+	r.poolSize = *workdirPoolSize
+	r.pullFrequency = c.pullFrequency
+	if c.Crontab != "" {
+		r.crontabPath = c.Crontab
+	}
+	r.crontabRef = *crontabRef
+	if c.CrontabRef != "" {
+		r.crontabRef = c.CrontabRef
+	}
+	branch := *branch
+	if c.Branch != "" {
+		branch = c.Branch
+	}
+	if branch != "" {
+		if err := r.SetBranch(branch); err != nil {
+			r.Close()
+			return fmt.Errorf("couldn't check out %s: %s", branch, err)
+		}
+	}
+
+	m.mu.Lock()
+	queue := newCrontabQueue()
+	m.repos[name] = &managedRepo{
+		repo:       r,
+		queue:      queue,
+		pausedTags: make(map[string]bool),
+		succeeded:  make(map[string]bool),
+		started:    make(map[string]bool),
+		busy:       make(map[string]int),
+		outcomes:   make(map[string]*JobStatus),
+	}
+	m.mu.Unlock()
+
+	watchCrontab(m, r, queue)
+	watchMaster(m, r)
+	compactHistory(m, r)
+	heartbeat(m, r)
+	retainOutputLogs(m, r)
+	m.goBackground(func() { executeCrontab(m, r, queue, c.After) })
+	return nil
+}
+
+// goBackground runs f in a goroutine that Shutdown waits for before closing repos, unless m has started shutting down.
+// f must return once m.stopping is closed.
+func (m *Manager) goBackground(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return
+	}
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		f()
+	}()
+}
+
+// setJobs records the jobs currently scheduled for the named repo,
+// along with how many entries its crontab has and which of them were rejected.
+func (m *Manager) setJobs(name string, parsed int, jobs []job, rejected []RejectedEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mr := m.repos[name]
+	mr.parsed = parsed
+	mr.jobs = jobs
+	mr.rejected = rejected
+}
+
+// scheduledJobs returns a snapshot of the jobs currently scheduled for each repo.
+func (m *Manager) scheduledJobs() map[string][]job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := make(map[string][]job, len(m.repos))
+	for name, mr := range m.repos {
+		snapshot[name] = mr.jobs
+	}
+	return snapshot
+}
+
+// recordPull records the outcome of an attempt to pull the named repo's crontab.
+func (m *Manager) recordPull(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mr := m.repos[name]
+	mr.lastPull = time.Now()
+	mr.lastPullError = err
+}
+
+// LoadState reads when each @since_success job last succeeded from the file at path,
+// in which they're recorded from then on.
+func (m *Manager) LoadState(path string) error {
+	s, err := readState(path)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.successes = s
+	m.stateFile = path
+	return nil
+}
+
+// lastSuccess returns when command in the named repo last succeeded, or the zero time if it never has.
+func (m *Manager) lastSuccess(name, command string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.successes[name][command]
+}
+
+// recordSuccess records that command in the named repo succeeded at t, writing it to the state file if there is one.
+// m.mu must be held.
+func (m *Manager) recordSuccess(name, command string, t time.Time) {
+	if m.successes[name] == nil {
+		m.successes[name] = make(map[string]time.Time)
+	}
+	m.successes[name][command] = t
+	if m.stateFile == "" {
+		return
+	}
+	if err := writeState(m.stateFile, m.successes); err != nil {
+		glog.Errorf("error recording success of %s in %s: %s", command, m.stateFile, err)
+	}
+}
+
+// lock returns the named lock, creating it if need be.
+func (m *Manager) lock(name string) chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = make(chan struct{}, 1)
+		m.locks[name] = l
+	}
+	return l
+}
+
+// loadedChan returns a channel that's closed once the named repo's first crontab has been applied,
+// whether or not the repo has been added yet.
+func (m *Manager) loadedChan(name string) chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	loaded, ok := m.loaded[name]
+	if !ok {
+		loaded = make(chan struct{})
+		m.loaded[name] = loaded
+	}
+	return loaded
+}
+
+// markLoaded records that the named repo's crontab has been applied, starting any repos waiting on it.
+func (m *Manager) markLoaded(name string) {
+	loaded := m.loadedChan(name)
+	select {
+	case <-loaded:
+	default:
+		close(loaded)
+	}
+}
+
+// Pause skips scheduled runs of jobs in the named repo, or in every repo if name is empty, until resumed.
+// Jobs that are already running are left to finish.
+func (m *Manager) Pause(name string) error {
+	return m.setPaused(name, "", true)
+}
+
+// Resume undoes Pause for the named repo, or for every repo if name is empty.
+// Resuming a single repo has no effect while every repo is paused.
+func (m *Manager) Resume(name string) error {
+	return m.setPaused(name, "", false)
+}
+
+// PauseTag is like Pause, but only skips runs of jobs tagged with tag, unless tag is empty.
+func (m *Manager) PauseTag(name, tag string) error {
+	return m.setPaused(name, tag, true)
+}
+
+// ResumeTag undoes PauseTag for the named repo, or for every repo if name is empty.
+// Resuming a tag in a single repo has no effect while it's paused in every repo.
+func (m *Manager) ResumeTag(name, tag string) error {
+	return m.setPaused(name, tag, false)
+}
+
+// setPaused pauses or resumes the named repo, or every repo if name is empty,
+// or if tag isn't empty, just the jobs in it tagged with tag.
+func (m *Manager) setPaused(name, tag string, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "" {
+		if tag == "" {
+			m.paused = paused
+		} else {
+			setTagPaused(m.pausedTags, tag, paused)
+		}
+		for _, mr := range m.repos {
+			if tag == "" {
+				mr.paused = false
+			} else {
+				delete(mr.pausedTags, tag)
+			}
+		}
+		return nil
+	}
+	mr, ok := m.repos[name]
+	if !ok {
+		return fmt.Errorf("no repo named %s", name)
+	}
+	if tag == "" {
+		mr.paused = paused
+	} else {
+		setTagPaused(mr.pausedTags, tag, paused)
+	}
+	return nil
+}
+
+func setTagPaused(tags map[string]bool, tag string, paused bool) {
+	if paused {
+		tags[tag] = true
+	} else {
+		delete(tags, tag)
+	}
+}
+
+// pausedTag returns one of j's tags that's paused in mr or in every repo, or "" if none are.
+// m.mu must be held.
+func (m *Manager) pausedTag(mr *managedRepo, j job) string {
+	for _, tag := range j.tags {
+		if m.pausedTags[tag] || mr.pausedTags[tag] {
+			return tag
+		}
+	}
+	return ""
+}
+
+// runJob executes a scheduled run of j in repo, scheduled for the given time, by way of run.
+// Returns without running anything if the manager is shutting down, if j's repo or one of its tags is paused,
+// if j must run after a job whose most recent run didn't succeed, if j is cooling down after failing,
+// or if run doesn't run it.
+func (m *Manager) runJob(repo *repo, j job, scheduled time.Time, trigger trigger) {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		glog.Infof("shutting down, not running: %s", j.Command)
+		return
+	}
+	if m.paused || m.repos[repo.name].paused {
+		m.mu.Unlock()
+		glog.Infof("paused, skipping run of: %s", j.Command)
+		return
+	}
+	if tag := m.pausedTag(m.repos[repo.name], j); tag != "" {
+		m.mu.Unlock()
+		glog.Infof("%s is paused, skipping run of: %s", tag, j.Command)
+		return
+	}
+	if j.after != "" && !m.repos[repo.name].succeeded[j.after] {
+		m.mu.Unlock()
+		glog.Infof("most recent run of %s didn't succeed, not running: %s", j.after, j.Command)
+		return
+	}
+	if status, ok := m.repos[repo.name].outcomes[j.Command]; ok && status.CooldownUntil != nil && j.failureCooldown > 0 {
+		if until := *status.CooldownUntil; m.Clock.Now().Before(until) {
+			m.mu.Unlock()
+			glog.Infof("failed recently, not running until %s: %s", until.Format(time.RFC3339), j.Command)
+			return
+		}
+	}
+	if j.window != nil && !j.window.contains(scheduled) {
+		m.mu.Unlock()
+		glog.Infof("outside its window of %s, skipping run of: %s", j.window.spec, j.Command)
+		return
+	}
+	if m.DryRun {
+		m.mu.Unlock()
+		glog.Infof("%s: would run in %s: %s", m.Clock.Now().Format(time.RFC3339), repo.name, j.Command)
+		return
+	}
+	m.mu.Unlock()
+	// Whatever kept it from running has been logged.
+	m.run(repo, j, scheduled, trigger)
+}
+
+// Errors returned by Manager.run when it doesn't run a job.
+var (
+	errAlreadyRunning = errors.New("already running")
+	errShuttingDown   = errors.New("shutting down")
+)
+
+// run executes a single run of j in repo, scheduled for the given time and caused by trigger,
+// once there's room under the concurrency limit and once it holds j's named lock, if any,
+// recording its outcome, then returns its result.
+// If j has skip_first, its first run's events aren't published.
+// Returns an error without running anything if the run was triggered manually while j's entry is already running,
+// if the manager is shutting down, or if j's lock isn't free within -lock_timeout.
+// Scheduled runs may overlap earlier ones that haven't finished, as cron's do.
+func (m *Manager) run(repo *repo, j job, scheduled time.Time, trigger trigger) (RunResult, error) {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		glog.Infof("shutting down, not running: %s", j.Command)
+		return RunResult{}, errShuttingDown
+	}
+	mr := m.repos[repo.name]
+	key := j.key()
+	if trigger == triggerManual && mr.busy[key] > 0 {
+		m.mu.Unlock()
+		return RunResult{}, errAlreadyRunning
+	}
+	mr.busy[key]++
+	m.running.Add(1)
+	m.inFlight++
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.inFlight--
+		if mr.busy[key]--; mr.busy[key] == 0 {
+			delete(mr.busy, key)
+		}
+		m.mu.Unlock()
+		m.running.Done()
+	}()
+
+	if j.lock != "" {
+		var timeout <-chan time.Time
+		lockTimeout := settings().lockTimeout
+		if lockTimeout > 0 {
+			timer := time.NewTimer(lockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		l := m.lock(j.lock)
+		select {
+		case l <- struct{}{}:
+			defer func() { <-l }()
+		case <-timeout:
+			err := fmt.Errorf("timed out after %s waiting for lock %s", lockTimeout, j.lock)
+			glog.Errorf("%s, not running: %s", err, j.Command)
+			return RunResult{}, err
+		case <-m.stopping:
+			glog.Infof("shutting down, not running: %s", j.Command)
+			return RunResult{}, errShuttingDown
+		}
+	}
+
+	m.mu.Lock()
+	slots := m.slots
+	m.mu.Unlock()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			// Release the slot taken, even if the limit has since changed.
+			defer func() { <-slots }()
+		case <-m.stopping:
+			glog.Infof("shutting down, not running: %s", j.Command)
+			return RunResult{}, errShuttingDown
+		}
+	}
+
+	m.mu.Lock()
+	mr.running++
+	bus := m.Events
+	if j.skipFirst && !mr.started[j.Command] {
+		glog.Infof("first run, so not publishing its events: %s", j.Command)
+		bus = nil
+	}
+	mr.started[j.Command] = true
+	m.mu.Unlock()
+
+	result := executeCommand(bus, j, repo, scheduled, trigger, m.terminating)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mr.running--
+	mr.runs++
+	if j.name != "" {
+		mr.succeeded[j.name] = result.Err == nil
+	}
+	status, ok := mr.outcomes[j.Command]
+	if !ok {
+		status = &JobStatus{Command: j.Command}
+		mr.outcomes[j.Command] = status
+	}
+	switch result.Outcome() {
+	case OutcomeCommitted:
+		status.Committed++
+	case OutcomeUnchanged:
+		status.Unchanged++
+	case OutcomeFailed:
+		status.Failed++
+	case OutcomeCommandNotFound:
+		status.CommandNotFound++
+	}
+	if result.Err == nil && j.Schedule.SinceSuccess() > 0 {
+		m.recordSuccess(repo.name, j.Command, m.Clock.Now())
+	}
+	if result.KeptBranch != "" {
+		mr.failedBranches = append(mr.failedBranches, FailedBranch{result.KeptBranch, j.Command, result.Start})
+	}
+	status.LastOutcome = result.Outcome()
+	status.LastChanged = result.Changed
+	status.CooldownUntil = nil
+	if result.Err != nil && j.failureCooldown > 0 {
+		// Measured on m.Clock, like the schedule it's checked against.
+		until := m.Clock.Now().Add(j.failureCooldown)
+		status.CooldownUntil = &until
+	}
+	return result, nil
+}
+
+// RunNow runs the job in the named repo, or in any repo if name is empty, whose name is jobName if that isn't empty,
+// or whose command contains command otherwise, right away, outside of its schedule, and returns its result.
+// It's run even if it's paused or cooling down, but not while it's already running.
+func (m *Manager) RunNow(name, jobName, command string) (RunResult, error) {
+	var matches []job
+	var repo *repo
+	m.mu.Lock()
+	for n, mr := range m.repos {
+		if name != "" && n != name {
+			continue
+		}
+		for _, j := range mr.jobs {
+			if jobName != "" && j.name == jobName || jobName == "" && strings.Contains(j.Command, command) {
+				matches = append(matches, j)
+				repo = mr.repo
+			}
+		}
+	}
+	dryRun := m.DryRun
+	m.mu.Unlock()
+	if len(matches) == 0 {
+		return RunResult{}, errNoSuchJob
+	}
+	if len(matches) > 1 {
+		var commands []string
+		for _, j := range matches {
+			commands = append(commands, j.Command)
+		}
+		return RunResult{}, fmt.Errorf("%d jobs match: %s", len(matches), strings.Join(commands, "; "))
+	}
+	j := matches[0]
+	if dryRun {
+		return RunResult{}, fmt.Errorf("not running jobs while simulating")
+	}
+	glog.Infof("running out of schedule: %s", j.Command)
+	return m.run(repo, j, m.Clock.Now(), triggerManual)
+}
+
+// errNoSuchJob is returned by RunNow when no job matches.
+var errNoSuchJob = errors.New("no job matches")
+
+// Status summarizes each repo, ordered by name.
+// If tag isn't empty, each repo's Jobs only include the commands of scheduled jobs tagged with it.
+func (m *Manager) Status(tag string) []RepoStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var statuses []RepoStatus
+	for name, mr := range m.repos {
+		status := RepoStatus{
+			Name:     name,
+			Entries:  len(mr.jobs),
+			Parsed:   mr.parsed,
+			Rejected: mr.rejected,
+			LastPull: mr.lastPull,
+			Runs:     mr.runs,
+			Running:  mr.running,
+			Paused:   m.paused || mr.paused,
+		}
+		status.FailedBranches = mr.failedBranches
+		status.ActiveWorkdirs = mr.repo.ActiveWorkdirs()
+		status.PendingCrontabs, status.SupersededCrontabs, status.LastCrontabApplied = mr.queue.stats()
+		if mr.lastPullError != nil {
+			status.LastPullError = mr.lastPullError.Error()
+			if pullErr, ok := mr.lastPullError.(*PullError); ok {
+				status.LastPullErrorKind = pullErr.Kind
+			}
+		}
+		for t := range m.pausedTags {
+			status.PausedTags = append(status.PausedTags, t)
+		}
+		for t := range mr.pausedTags {
+			if !m.pausedTags[t] {
+				status.PausedTags = append(status.PausedTags, t)
+			}
+		}
+		sort.Strings(status.PausedTags)
+		tagged := make(map[string]bool)
+		for _, j := range mr.jobs {
+			if j.hasTag(tag) {
+				tagged[j.Command] = true
+			}
+		}
+		for _, job := range mr.outcomes {
+			if tag == "" || tagged[job.Command] {
+				status.Jobs = append(status.Jobs, *job)
+			}
+		}
+		sort.Sort(byCommand(status.Jobs))
+		statuses = append(statuses, status)
+	}
+	sort.Sort(byName(statuses))
+	return statuses
+}
+
+type byName []RepoStatus
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byCommand []JobStatus
+
+func (s byCommand) Len() int           { return len(s) }
+func (s byCommand) Less(i, j int) bool { return s[i].Command < s[j].Command }
+func (s byCommand) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Idle determines whether no job is running, and none is due to run within horizon.
+// It's never idle before every repo's crontab has been applied, or while a newer one is waiting to be.
+func (m *Manager) Idle(horizon time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inFlight > 0 {
+		return false
+	}
+	now := m.Clock.Now()
+	for name, mr := range m.repos {
+		if pending, _, lastApplied := mr.queue.stats(); pending > 0 || lastApplied.IsZero() {
+			return false
+		}
+		for _, j := range mr.jobs {
+			next := j.Schedule.Next(now)
+			if every := j.Schedule.SinceSuccess(); every > 0 {
+				// As the scheduler works it out; see crontab.Scheduler.next.
+				if next = m.successes[name][j.Command].Add(every); !next.After(now) {
+					next = now.Add(every)
+				}
+			}
+			if !next.IsZero() && next.Sub(now) <= horizon {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Shutdown stops scheduling new jobs, waits for in-flight jobs to finish, runs -on_shutdown in each repo,
+// then cleans up each repo's local clone.
+// If jobs are still running after -shutdown_timeout, they're terminated.
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	m.stopped = true
+	close(m.stopping)
+	m.mu.Unlock()
+
+	glog.Infof("waiting for running jobs to finish...")
+	finished := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(finished)
+	}()
+	var timedOut <-chan time.Time
+	shutdownTimeout := settings().shutdownTimeout
+	if shutdownTimeout > 0 {
+		timedOut = time.After(shutdownTimeout)
+	}
+	select {
+	case <-finished:
+	case <-timedOut:
+		glog.Warningf("jobs still running after %s, terminating them...", shutdownTimeout)
+		close(m.terminating)
+		<-finished
+	}
+	m.background.Wait()
+
+	// Finalizing and closing repos can take a while, so don't hold m.mu, keeping the status page and API responsive.
+	m.mu.Lock()
+	repos := make(map[string]*repo, len(m.repos))
+	for name, mr := range m.repos {
+		repos[name] = mr.repo
+	}
+	m.mu.Unlock()
+	for name, repo := range repos {
+		if err := runShutdownCommand(repo); err != nil {
+			glog.Errorf("error running -on_shutdown in %s: %s", name, err)
+		}
+		if err := repo.Close(); err != nil {
+			glog.Errorf("error cleaning up %s: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,883 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+func TestShutdownWaitsForBackgroundGoroutines(t *testing.T) {
+	m := NewManager(0)
+	var finished int32
+	m.goBackground(func() {
+		<-m.stopping
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	})
+	m.Shutdown()
+	if atomic.LoadInt32(&finished) == 0 {
+		t.Error("Shutdown returned before a background goroutine exited")
+	}
+
+	started := false
+	m.goBackground(func() { started = true })
+	m.background.Wait()
+	if started {
+		t.Error("goroutine started after Shutdown")
+	}
+}
+
+// newTestManager has a new Manager with git manage a clone of origin for the rest of the test,
+// running commands with executor, if it isn't nil, and scheduling them by clock, if it isn't nil,
+// returning the manager and the clone.
+func newTestManager(t *testing.T, git GitBackend, executor Executor, clock crontab.Clock, origin string) (*Manager, *repo) {
+	t.Helper()
+	m := NewManager(0)
+	m.Git = git
+	if executor != nil {
+		m.Executor = executor
+	}
+	if clock != nil {
+		m.Clock = clock
+		// Wait for each run on a single timer, so that setting the clock to its time fires it.
+		m.RecheckInterval = 24 * time.Hour
+	}
+	if err := m.Add(RepoConfig{Origin: origin}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Shutdown)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m, m.repos[origin].repo
+}
+
+// fakeClock is a crontab.Clock that only moves when it's set, firing the timers that are then due,
+// so that nothing scheduled runs on its own.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+// fakeTimer is a channel waiting for a fakeClock to reach a time.
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	return ch
+}
+
+// set moves the clock to now, firing any timers that are due.
+func (c *fakeClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	var pending []fakeTimer
+	for _, timer := range c.timers {
+		if timer.at.After(now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- now
+	}
+	c.timers = pending
+}
+
+// waiting returns how many timers haven't fired yet.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// eventually waits for cond to hold, failing the test with msg if it doesn't within a few seconds.
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitLoaded waits for the named repo's crontab to be applied by m, failing the test if it takes too long.
+func waitLoaded(t *testing.T, m *Manager, name string) {
+	t.Helper()
+	select {
+	case <-m.loadedChan(name):
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s's crontab wasn't loaded", name)
+	}
+}
+
+// concurrencyExecutor is an Executor that counts how many commands it's running at once, at most,
+// taking a while over each so that they'd overlap if they could.
+type concurrencyExecutor struct {
+	mu            sync.Mutex
+	running, most int
+	ran           []string
+}
+
+func (e *concurrencyExecutor) Execute(ctx context.Context, j job, dir string, env []string) ([]byte, int, error) {
+	e.mu.Lock()
+	e.running++
+	if e.running > e.most {
+		e.most = e.running
+	}
+	e.ran = append(e.ran, j.Command)
+	e.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	e.mu.Lock()
+	e.running--
+	e.mu.Unlock()
+	return nil, 0, nil
+}
+
+func TestManagerSharesConcurrencyLimitAcrossRepos(t *testing.T) {
+	setUpGit(t)
+	executor := &concurrencyExecutor{}
+	m := NewManager(1)
+	m.Executor = executor
+	m.Clock = &fakeClock{now: time.Now()}
+	t.Cleanup(m.Shutdown)
+	var repos []*repo
+	for _, command := range []string{"./a", "./b"} {
+		origin := newOrigin(t, map[string]string{"crontab": "0 0 * * * " + command + "\n"})
+		if err := m.Add(RepoConfig{Origin: origin}); err != nil {
+			t.Fatal(err)
+		}
+		waitLoaded(t, m, origin)
+		m.mu.Lock()
+		repos = append(repos, m.repos[origin].repo)
+		m.mu.Unlock()
+	}
+
+	scheduled := m.scheduledJobs()
+	if len(scheduled) != 2 {
+		t.Fatalf("scheduled jobs for %d repos, want 2", len(scheduled))
+	}
+	var wg sync.WaitGroup
+	for _, r := range repos {
+		for _, j := range scheduled[r.name] {
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func(r *repo) {
+					defer wg.Done()
+					if _, err := m.run(r, j, time.Now(), triggerSchedule); err != nil {
+						t.Error(err)
+					}
+				}(r)
+			}
+		}
+	}
+	wg.Wait()
+	if len(executor.ran) != 4 {
+		t.Errorf("ran %v, want 2 runs of each repo's job", executor.ran)
+	}
+	if executor.most != 1 {
+		t.Errorf("ran %d jobs at once across both repos, want at most 1", executor.most)
+	}
+}
+
+// pullCountingBackend is a GitBackend that counts how many pulls and fetches it's running at once, at most,
+// once counting, taking a while over each so that they'd overlap if they could.
+type pullCountingBackend struct {
+	execGit
+
+	mu                      sync.Mutex
+	counting                bool
+	running, most, finished int
+}
+
+func (g *pullCountingBackend) count(pull func() error) error {
+	g.mu.Lock()
+	counting := g.counting
+	if counting {
+		g.running++
+		if g.running > g.most {
+			g.most = g.running
+		}
+	}
+	g.mu.Unlock()
+	if !counting {
+		return pull()
+	}
+	time.Sleep(20 * time.Millisecond)
+	err := pull()
+	g.mu.Lock()
+	g.running--
+	g.finished++
+	g.mu.Unlock()
+	return err
+}
+
+func (g *pullCountingBackend) Fetch(dir, ref string) error {
+	return g.count(func() error { return g.execGit.Fetch(dir, ref) })
+}
+
+func (g *pullCountingBackend) Pull(dir string, ffOnly bool) error {
+	return g.count(func() error { return g.execGit.Pull(dir, ffOnly) })
+}
+
+func TestMaxConcurrentPulls(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "pull_frequency", "10ms")
+	// So that each pull fetches, rather than seeing origin unchanged.
+	setFlag(t, "check_remote_head", "false")
+	git := &pullCountingBackend{}
+	m := NewManager(0)
+	m.Git = git
+	m.SetMaxConcurrentPulls(1)
+	t.Cleanup(m.Shutdown)
+	for i := 0; i < 3; i++ {
+		origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+		if err := m.Add(RepoConfig{Origin: origin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only once all are cloned, since cloning isn't limited.
+	git.mu.Lock()
+	git.counting = true
+	git.mu.Unlock()
+	eventually(t, "repos didn't keep pulling", func() bool {
+		git.mu.Lock()
+		defer git.mu.Unlock()
+		return git.finished >= 20
+	})
+	git.mu.Lock()
+	defer git.mu.Unlock()
+	if git.most != 1 {
+		t.Errorf("pulled %d times at once across 3 repos, want at most 1", git.most)
+	}
+}
+
+func TestRunsAfterSuccessfulPrerequisite(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	m, r := newTestManager(t, execGit{}, nil, &fakeClock{now: time.Now()}, origin)
+
+	built := filepath.Join(t.TempDir(), "built")
+	build := testJob(t, "# crony: name=build\n0 * * * * test -e "+built)
+	deploy := testJob(t, "# crony: after=build\n30 * * * * date > deployed.txt")
+	deployed := func() bool { return originFile(t, origin, "master", "deployed.txt") != "" }
+
+	m.runJob(r, deploy, time.Now(), triggerSchedule)
+	if deployed() {
+		t.Fatal("deployed before the build ever ran")
+	}
+	m.runJob(r, build, time.Now(), triggerSchedule)
+	m.runJob(r, deploy, time.Now(), triggerSchedule)
+	if deployed() {
+		t.Fatal("deployed after the build failed")
+	}
+
+	writeFile(t, built, "")
+	m.runJob(r, build, time.Now(), triggerSchedule)
+	m.runJob(r, deploy, time.Now(), triggerSchedule)
+	if !deployed() {
+		t.Fatal("didn't deploy after the build succeeded")
+	}
+}
+
+func TestRunChangingNothingIsUnchanged(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	m, r := newTestManager(t, execGit{}, nil, nil, origin)
+	var mu sync.Mutex
+	var completed []RunResult
+	m.Events.Subscribe(func(e Event) {
+		if e.Type == JobCompleted {
+			mu.Lock()
+			completed = append(completed, *e.Result)
+			mu.Unlock()
+		}
+	})
+	before := runGit(t, origin, "rev-parse", "master")
+
+	result, err := m.run(r, testJob(t, "0 0 * * * echo checked"), time.Now(), triggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Err != nil || result.Changed || result.Outcome() != OutcomeUnchanged {
+		t.Errorf("outcome=%s changed=%t err=%v, want %s with changed=false", result.Outcome(), result.Changed, result.Err, OutcomeUnchanged)
+	}
+	if after := runGit(t, origin, "rev-parse", "master"); after != before {
+		t.Error("committed a run that changed nothing")
+	}
+	mu.Lock()
+	if len(completed) != 1 || completed[0].Changed || completed[0].Outcome() != OutcomeUnchanged {
+		t.Errorf("%s events had results %+v, want one with changed=false", JobCompleted, completed)
+	}
+	mu.Unlock()
+	statuses := m.Status("")
+	if len(statuses) != 1 || len(statuses[0].Jobs) != 1 {
+		t.Fatalf("status is %+v, want one repo with one job", statuses)
+	}
+	if got := statuses[0].Jobs[0]; got.Unchanged != 1 || got.Committed != 0 || got.LastChanged || got.LastOutcome != OutcomeUnchanged {
+		t.Errorf("job status is %+v, want one unchanged run", got)
+	}
+}
+
+func TestSkipFirst(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	m, r := newTestManager(t, execGit{}, nil, nil, origin)
+	events := recordEvents(m.Events)
+
+	j := testJob(t, "# crony: skip_first\n0 0 * * * date +%N > baseline.txt; exit 1")
+	if _, err := m.run(r, j, time.Now(), triggerManual); err != nil {
+		t.Fatal(err)
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("first run published %v, want no events", got)
+	}
+	if originFile(t, origin, "master", "baseline.txt") == "" {
+		t.Error("first run's baseline wasn't committed")
+	}
+
+	if _, err := m.run(r, j, time.Now(), triggerManual); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(events()); !strings.Contains(got, string(JobFinished)) || !strings.Contains(got, string(JobCompleted)) {
+		t.Errorf("second run published %s, want %s and %s", got, JobFinished, JobCompleted)
+	}
+
+	// Without skip_first, even the first run publishes its events.
+	before := len(events())
+	if _, err := m.run(r, testJob(t, "0 0 * * * date +%N > other.txt"), time.Now(), triggerManual); err != nil {
+		t.Fatal(err)
+	}
+	if len(events()) == before {
+		t.Error("first run of an entry without skip_first published no events")
+	}
+}
+
+func TestLockSerializesRunsAcrossRepos(t *testing.T) {
+	setUpGit(t)
+	executor := &concurrencyExecutor{}
+	m := NewManager(0)
+	m.Executor = executor
+	m.Clock = &fakeClock{now: time.Now()}
+	t.Cleanup(m.Shutdown)
+	var repos []*repo
+	for i := 0; i < 2; i++ {
+		origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+		if err := m.Add(RepoConfig{Origin: origin}); err != nil {
+			t.Fatal(err)
+		}
+		m.mu.Lock()
+		repos = append(repos, m.repos[origin].repo)
+		m.mu.Unlock()
+	}
+
+	j := testJob(t, "# crony: lock=db\n0 0 * * * ./backup")
+	var wg sync.WaitGroup
+	for _, r := range repos {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(r *repo) {
+				defer wg.Done()
+				if _, err := m.run(r, j, time.Now(), triggerSchedule); err != nil {
+					t.Error(err)
+				}
+			}(r)
+		}
+	}
+	wg.Wait()
+	if len(executor.ran) != 4 {
+		t.Errorf("ran %v, want 2 runs in each repo", executor.ran)
+	}
+	if executor.most != 1 {
+		t.Errorf("ran %d entries sharing a lock at once, want 1", executor.most)
+	}
+}
+
+// blockingExecutor is an Executor whose commands each report their start, then wait to be released.
+type blockingExecutor struct {
+	started chan string
+	release chan struct{}
+}
+
+func (e *blockingExecutor) Execute(ctx context.Context, j job, dir string, env []string) ([]byte, int, error) {
+	e.started <- j.Command
+	<-e.release
+	return nil, 0, nil
+}
+
+func TestOnlyManualRunsWaitForTheirEntry(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	executor := &blockingExecutor{started: make(chan string, 3), release: make(chan struct{})}
+	m, r := newTestManager(t, execGit{}, executor, &fakeClock{now: time.Now()}, origin)
+	waitStarted := func(what string) {
+		t.Helper()
+		select {
+		case <-executor.started:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s didn't start", what)
+		}
+	}
+
+	hourly := testJob(t, "0 * * * * ./sync")
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runJob(r, hourly, time.Now(), triggerSchedule)
+		}()
+	}
+	waitStarted("first scheduled run")
+	waitStarted("second scheduled run, overlapping the first,")
+
+	if _, err := m.run(r, hourly, time.Now(), triggerManual); err != errAlreadyRunning {
+		t.Errorf("manual run of an entry that's running returned %v, want %v", err, errAlreadyRunning)
+	}
+	// Another entry running the same command isn't held up.
+	daily := testJob(t, "0 0 * * * ./sync")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := m.run(r, daily, time.Now(), triggerManual); err != nil {
+			t.Error(err)
+		}
+	}()
+	waitStarted("manual run of another entry with the same command")
+	close(executor.release)
+	wg.Wait()
+	if runs := m.Status("")[0].Runs; runs != 3 {
+		t.Errorf("ran %d times, want 3", runs)
+	}
+}
+
+func TestFailureCooldown(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	start := time.Date(2026, time.October, 15, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	m, r := newTestManager(t, execGit{}, nil, clock, origin)
+	j := testJob(t, "# crony: failure_cooldown=10m\n* * * * * exit 1")
+	failed := func() int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if status, ok := m.repos[origin].outcomes[j.Command]; ok {
+			return status.Failed
+		}
+		return 0
+	}
+
+	var runs []int
+	for minute := 0; minute < 25; minute++ {
+		now := start.Add(time.Duration(minute) * time.Minute)
+		clock.set(now)
+		before := failed()
+		m.runJob(r, j, now, triggerSchedule)
+		if failed() > before {
+			runs = append(runs, minute)
+		}
+	}
+	if got, want := fmt.Sprint(runs), "[0 10 20]"; got != want {
+		t.Errorf("ran at minutes %s of a job failing every minute, want %s", got, want)
+	}
+}
+
+func TestStatusCountsRejectedEntries(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": `0 * * * * ./hourly
+# crony: nice=99
+0 0 * * * ./too-nice
+# crony: after=missing
+30 * * * * ./orphan
+0 0 1 * * ./monthly
+`})
+	m, _ := newTestManager(t, execGit{}, nil, &fakeClock{now: time.Now()}, origin)
+	waitLoaded(t, m, origin)
+
+	statuses := m.Status("")
+	if len(statuses) != 1 {
+		t.Fatalf("status has %d repos, want 1", len(statuses))
+	}
+	status := statuses[0]
+	if status.Parsed != 4 || status.Entries != 2 || len(status.Rejected) != 2 {
+		t.Errorf("parsed=%d scheduled=%d rejected=%d, want 4 parsed, 2 scheduled, and 2 rejected",
+			status.Parsed, status.Entries, len(status.Rejected))
+	}
+	for i, want := range []RejectedEntry{
+		{"./too-nice", "nice must be an integer from -20 to 19: 99"},
+		{"./orphan", "no entry named missing to run after"},
+	} {
+		if i < len(status.Rejected) && status.Rejected[i] != want {
+			t.Errorf("rejected %+v, want %+v", status.Rejected[i], want)
+		}
+	}
+}
+
+func TestEntryWithoutCommandIsRejected(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * *\n0 * * * * ./hourly\n"})
+	clock := &fakeClock{now: time.Date(2026, time.March, 1, 12, 30, 0, 0, time.UTC)}
+	executor := &recordingExecutor{}
+	m, _ := newTestManager(t, execGit{}, executor, clock, origin)
+	waitLoaded(t, m, origin)
+
+	status := m.Status("")[0]
+	if want := (RejectedEntry{"", "no command"}); status.Entries != 1 || len(status.Rejected) != 1 || status.Rejected[0] != want {
+		t.Errorf("scheduled %d entries and rejected %+v, want ./hourly scheduled and %+v rejected",
+			status.Entries, status.Rejected, want)
+	}
+	// Only ./hourly is waiting for 13:00, though the entry without a command would have run then, too.
+	eventually(t, "./hourly isn't waiting for its next run", func() bool { return clock.waiting() == 1 })
+	clock.set(time.Date(2026, time.March, 1, 13, 0, 0, 0, time.UTC))
+	eventually(t, "./hourly didn't run at 13:00", func() bool { return len(executor.recorded()) == 1 })
+	eventually(t, "./hourly isn't waiting for its next run", func() bool { return clock.waiting() == 1 })
+	if executions := executor.recorded(); len(executions) != 1 || executions[0].command != "./hourly" {
+		t.Errorf("executed %v, want just ./hourly", executions)
+	}
+}
+
+func TestDuplicateEntries(t *testing.T) {
+	for _, test := range []struct {
+		dedup bool
+		// Entries scheduled, each running ./report at 13:00.
+		scheduled int
+		rejected  []RejectedEntry
+	}{
+		{false, 2, nil},
+		{true, 1, []RejectedEntry{{"./report", "duplicate entry"}}},
+	} {
+		t.Run(fmt.Sprintf("dedup=%t", test.dedup), func(t *testing.T) {
+			setUpGit(t)
+			setFlag(t, "dedup_entries", strconv.FormatBool(test.dedup))
+			// The same entry, written two ways.
+			origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./report\n0 0-23 * * * ./report\n"})
+			clock := &fakeClock{now: time.Date(2026, time.March, 1, 12, 30, 0, 0, time.UTC)}
+			executor := &recordingExecutor{}
+			m, _ := newTestManager(t, execGit{}, executor, clock, origin)
+			waitLoaded(t, m, origin)
+
+			status := m.Status("")[0]
+			if status.Entries != test.scheduled || !reflect.DeepEqual(status.Rejected, test.rejected) {
+				t.Errorf("scheduled %d entries and rejected %+v, want %d scheduled and %+v rejected",
+					status.Entries, status.Rejected, test.scheduled, test.rejected)
+			}
+			eventually(t, "entries aren't waiting for their next runs", func() bool { return clock.waiting() == test.scheduled })
+			clock.set(time.Date(2026, time.March, 1, 13, 0, 0, 0, time.UTC))
+			eventually(t, "./report didn't run at 13:00", func() bool { return len(executor.recorded()) == test.scheduled })
+			eventually(t, "entries aren't waiting for their next runs", func() bool { return clock.waiting() == test.scheduled })
+			if n := len(executor.recorded()); n != test.scheduled {
+				t.Errorf("./report ran %d times at 13:00, want %d", n, test.scheduled)
+			}
+		})
+	}
+}
+
+func TestPreconditionDefersScheduling(t *testing.T) {
+	setUpGit(t)
+	ready := filepath.Join(t.TempDir(), "ready")
+	setFlag(t, "precondition", "test -e "+ready)
+	origin := newOrigin(t, map[string]string{"crontab": "# crony: run_on_start\n0 * * * * ./hourly\n"})
+	start := time.Date(2026, time.October, 15, 12, 30, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	executor := &recordingExecutor{}
+	newTestManager(t, execGit{}, executor, clock, origin)
+
+	// The first retry is in 10s, the next 20s after that.
+	eventually(t, "no retry of the failed precondition is waiting", func() bool { return clock.waiting() == 1 })
+	clock.set(start.Add(10 * time.Second))
+	eventually(t, "no second retry of the failed precondition is waiting", func() bool { return clock.waiting() == 1 })
+	clock.set(start.Add(29 * time.Second))
+	if n := len(executor.recorded()); n != 0 {
+		t.Fatalf("ran %d times while the precondition failed, want 0", n)
+	}
+
+	writeFile(t, ready, "")
+	clock.set(start.Add(30 * time.Second))
+	eventually(t, "jobs weren't scheduled once the precondition passed", func() bool { return len(executor.recorded()) == 1 })
+}
+
+func TestPauseTag(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	executor := &recordingExecutor{}
+	m, r := newTestManager(t, execGit{}, executor, &fakeClock{now: time.Now()}, origin)
+	jobs := []job{
+		testJob(t, "# crony: tags=batch\n0 * * * * ./reindex"),
+		testJob(t, "# crony: tags=critical,batch\n0 * * * * ./backup"),
+		testJob(t, "# crony: tags=critical\n0 * * * * ./renew-certs"),
+		testJob(t, "0 * * * * ./untagged"),
+	}
+	ran := func() string {
+		for _, j := range jobs {
+			m.runJob(r, j, time.Now(), triggerSchedule)
+		}
+		var commands []string
+		for _, e := range executor.recorded() {
+			commands = append(commands, e.command)
+		}
+		executor.mu.Lock()
+		executor.executions = nil
+		executor.mu.Unlock()
+		return strings.Join(commands, " ")
+	}
+
+	if err := m.PauseTag("", "batch"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ran(), "./renew-certs ./untagged"; got != want {
+		t.Errorf("with batch paused, ran %s, want %s", got, want)
+	}
+	if err := m.PauseTag(origin, "critical"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ran(), "./untagged"; got != want {
+		t.Errorf("with batch and critical paused, ran %s, want %s", got, want)
+	}
+	if err := m.ResumeTag("", "batch"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ResumeTag(origin, "critical"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ran(), "./reindex ./backup ./renew-certs ./untagged"; got != want {
+		t.Errorf("after resuming, ran %s, want %s", got, want)
+	}
+}
+
+func TestKeepFailedBranches(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	m, r := newTestManager(t, execGit{}, nil, nil, origin)
+	j := testJob(t, "0 * * * * echo partial > partial.txt; exit 1")
+	failedBranches := func() []string {
+		return strings.Fields(runGit(t, origin, "branch", "--list", "--format=%(refname:short)", "crony/failed/*"))
+	}
+
+	if _, err := m.run(r, j, time.Now(), triggerManual); err != nil {
+		t.Fatal(err)
+	}
+	if branches := failedBranches(); len(branches) != 0 {
+		t.Errorf("kept branches %v without -keep_failed_branches", branches)
+	}
+
+	setFlag(t, "keep_failed_branches", "true")
+	result, err := m.run(r, j, time.Now(), triggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branches := failedBranches()
+	if len(branches) != 1 || branches[0] != result.KeptBranch || !strings.HasPrefix(result.KeptBranch, "crony/failed/echo-partial") {
+		t.Fatalf("kept branches %v in origin, and reported %q, want one for the failed run", branches, result.KeptBranch)
+	}
+	if got := originFile(t, origin, result.KeptBranch, "partial.txt"); got != "partial\n" {
+		t.Errorf("partial.txt on the kept branch is %q, want the failed run's", got)
+	}
+	if originFile(t, origin, result.KeptBranch, ".fail") == "" {
+		t.Error("the kept branch doesn't have the run's .fail file")
+	}
+	if statuses := m.Status(""); len(statuses) != 1 || len(statuses[0].FailedBranches) != 1 ||
+		statuses[0].FailedBranches[0].Branch != result.KeptBranch {
+		t.Errorf("status is %+v, want the kept branch listed", statuses)
+	}
+}
+
+func TestCrontabValidatorRejection(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "crontab_validator", "! grep -q forbidden")
+	setFlag(t, "pull_frequency", "20ms")
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./allowed\n"})
+	m, _ := newTestManager(t, execGit{}, &recordingExecutor{}, &fakeClock{now: time.Now()}, origin)
+	var mu sync.Mutex
+	var rejections []error
+	m.Events.Subscribe(func(e Event) {
+		if e.Type == CrontabRejected {
+			mu.Lock()
+			rejections = append(rejections, e.Err)
+			mu.Unlock()
+		}
+	})
+	rejected := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(rejections)
+	}
+	scheduled := func() string {
+		var commands []string
+		for _, j := range m.scheduledJobs()[origin] {
+			commands = append(commands, j.Command)
+		}
+		return strings.Join(commands, " ")
+	}
+	waitLoaded(t, m, origin)
+
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./allowed\n0 * * * * ./forbidden\n"}, "add a forbidden entry")
+	eventually(t, "the new crontab wasn't rejected", func() bool { return rejected() > 0 })
+	// Let it be pulled and rejected a few more times.
+	time.Sleep(200 * time.Millisecond)
+	if got := scheduled(); got != "./allowed" {
+		t.Errorf("scheduled %s after rejecting the new crontab, want the old one's ./allowed", got)
+	}
+	if n := rejected(); n != 1 {
+		t.Errorf("alerted %d times about the same rejected crontab, want once", n)
+	}
+
+	pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./allowed\n0 * * * * ./fixed\n"}, "fix the entry")
+	eventually(t, "the fixed crontab wasn't applied", func() bool { return scheduled() == "./allowed ./fixed" })
+}
+
+func TestInvalidCrontabKeepsPriorEntries(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "pull_frequency", "20ms")
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./hourly\n"})
+	start := time.Date(2026, time.October, 15, 12, 30, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	executor := &recordingExecutor{}
+	m, _ := newTestManager(t, execGit{}, executor, clock, origin)
+	waitLoaded(t, m, origin)
+	pullError := func() string {
+		statuses := m.Status(origin)
+		if len(statuses) != 1 {
+			t.Fatalf("status is %+v, want one repo", statuses)
+		}
+		return statuses[0].LastPullError
+	}
+
+	// As if caught mid-write, first before anything was written, then partway through a line.
+	for i, contents := range []string{"", "0 * * *"} {
+		pushToOrigin(t, origin, map[string]string{"crontab": contents}, "edit the crontab")
+		eventually(t, fmt.Sprintf("crontab %q wasn't rejected", contents), func() bool { return pullError() != "" })
+		if got := m.scheduledJobs()[origin]; len(got) != 1 || got[0].Command != "./hourly" {
+			t.Errorf("scheduled %v after pulling crontab %q, want the prior ./hourly", got, contents)
+		}
+		clock.set(start.Add(time.Duration(i+1) * time.Hour))
+		eventually(t, fmt.Sprintf("./hourly didn't keep running after pulling crontab %q", contents), func() bool {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return len(executor.recorded()) == i+1 && m.inFlight == 0
+		})
+		pushToOrigin(t, origin, map[string]string{"crontab": "0 * * * * ./hourly\n"}, "finish editing the crontab")
+		eventually(t, "the valid crontab wasn't pulled", func() bool { return pullError() == "" })
+	}
+}
+
+func TestClockJumpDoesNotBurst(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "0 * * * * ./hourly\n"})
+	start := time.Date(2026, time.October, 15, 12, 30, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	executor := &recordingExecutor{}
+	newTestManager(t, execGit{}, executor, clock, origin)
+
+	eventually(t, "the entry isn't waiting for its next run", func() bool { return clock.waiting() == 1 })
+	// Jump past five of its runs, as on resuming a suspended VM.
+	clock.set(start.Add(5*time.Hour + 30*time.Minute))
+	eventually(t, "the entry didn't run after the clock jumped", func() bool { return len(executor.recorded()) >= 1 })
+	eventually(t, "the entry isn't waiting for its next run", func() bool { return clock.waiting() == 1 })
+	if n := len(executor.recorded()); n != 1 {
+		t.Errorf("ran %d times after the clock jumped past 5 runs, want once", n)
+	}
+	clock.set(start.Add(6*time.Hour + 30*time.Minute))
+	eventually(t, "the entry didn't run on schedule after the jump", func() bool { return len(executor.recorded()) == 2 })
+}
+
+func TestOnShutdown(t *testing.T) {
+	setUpGit(t)
+	log := filepath.Join(t.TempDir(), "shutdown.log")
+	// Records the repo it's run for, and what the run in flight when shutting down committed to master.
+	setFlag(t, "on_shutdown", `echo "$CRONY_REPO $(cat done.txt)" >> `+log)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	m, r := newTestManager(t, execGit{}, nil, nil, origin)
+
+	ran := make(chan error, 1)
+	go func() {
+		_, err := m.run(r, testJob(t, "0 0 * * * sleep 0.5; echo done > done.txt"), time.Now(), triggerManual)
+		ran <- err
+	}()
+	eventually(t, "the run didn't start", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.inFlight > 0
+	})
+	m.Shutdown()
+	m.Shutdown()
+	if err := <-ran; err != nil {
+		t.Fatal(err)
+	}
+	logged, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(logged), origin+" done\n"; got != want {
+		t.Errorf("-on_shutdown logged %q, want it run once, after the run in flight, with %q", got, want)
+	}
+	if _, err := os.Stat(r.master.dir); !os.IsNotExist(err) {
+		t.Errorf("%s is still there after shutting down", r.master.dir)
+	}
+}
+
+func TestRepoStartsAfterPrerequisiteLoads(t *testing.T) {
+	setUpGit(t)
+	setFlag(t, "pull_frequency", "20ms")
+	m := NewManager(0)
+	m.Executor = &recordingExecutor{}
+	m.Clock = &fakeClock{now: time.Now()}
+	t.Cleanup(m.Shutdown)
+	// Without a crontab, the base repo's can't load until one's pushed.
+	base := newOrigin(t, map[string]string{"scripts/report.sh": "echo report\n"})
+	dependent := newOrigin(t, map[string]string{"crontab": "0 0 * * * ./report\n"})
+	if err := m.Add(RepoConfig{Origin: base, Name: "base"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(RepoConfig{Origin: dependent, Name: "dependent", After: []string{"base"}}); err != nil {
+		t.Fatal(err)
+	}
+	loaded := func(name string) bool {
+		select {
+		case <-m.loadedChan(name):
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Let the dependent repo's crontab be pulled a few times.
+	time.Sleep(200 * time.Millisecond)
+	if loaded("dependent") || len(m.scheduledJobs()["dependent"]) != 0 {
+		t.Fatal("the dependent repo's crontab was applied before the base repo's loaded")
+	}
+
+	pushToOrigin(t, base, map[string]string{"crontab": "# nothing scheduled\n"}, "add a crontab")
+	waitLoaded(t, m, "base")
+	waitLoaded(t, m, "dependent")
+	if got := m.scheduledJobs()["dependent"]; len(got) != 1 || got[0].Command != "./report" {
+		t.Errorf("the dependent repo scheduled %v once the base repo loaded, want ./report", got)
+	}
+}
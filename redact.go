@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"strings"
+)
+
+// regexpList is a flag.Value accumulating a regexp each time the flag is given.
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	var s []string
+	for _, re := range *l {
+		s = append(s, re.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *regexpList) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+var redactPatterns regexpList
+
+func init() {
+	flag.Var(&redactPatterns, "redact",
+		"Regexp matching secrets to replace with ***REDACTED*** in commands and their output before they're committed; may be repeated")
+}
+
+// redact replaces every match of -redact in s.
+func redact(s string) string {
+	for _, re := range redactPatterns {
+		s = re.ReplaceAllLiteralString(s, "***REDACTED***")
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+func TestRedactCommand(t *testing.T) {
+	saved := redactPatterns
+	defer func() { redactPatterns = saved }()
+	redactPatterns = regexpList{regexp.MustCompile(`hunter2`)}
+
+	entry, err := crontab.ParseEntry("* * * * * curl -u admin:hunter2 https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := newJob(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := runSubject(j.Command, 0); strings.Contains(subject, "hunter2") {
+		t.Errorf("runSubject(...) = %q, contains the secret", subject)
+	}
+	trailers := runTrailers(j, time.Now(), triggerSchedule, time.Now(), 0, nil)
+	if strings.Contains(trailers, "hunter2") {
+		t.Errorf("runTrailers(...) = %q, contains the secret", trailers)
+	}
+	if !strings.Contains(trailers, commandTrailer+": curl -u admin:***REDACTED*** https://example.com/\n") {
+		t.Errorf("runTrailers(...) = %q, want the redacted command", trailers)
+	}
+}
+
+func TestRedactCommittedOutput(t *testing.T) {
+	setUpGit(t)
+	saved := redactPatterns
+	defer func() { redactPatterns = saved }()
+	redactPatterns = regexpList{regexp.MustCompile(`ghp_[A-Za-z0-9]+`)}
+	origin := newOrigin(t, map[string]string{"crontab": "* * * * * true\n"})
+	r := newTestRepo(t, execGit{}, origin)
+
+	executeCommand(&EventBus{}, testJob(t, "* * * * * echo using ghp_abc123XYZ; exit 1"), r, time.Now(), triggerSchedule, nil)
+	msg := runGit(t, origin, "log", "-1", "--format=%B", "master")
+	if strings.Contains(msg, "ghp_abc123XYZ") {
+		t.Errorf("commit message contains the token: %q", msg)
+	}
+	if !strings.Contains(msg, "using ***REDACTED***\n") {
+		t.Errorf("commit message %q doesn't have the redacted output", msg)
+	}
+	if originFile(t, origin, "master", ".fail") == "" {
+		t.Error("the failed run's .fail wasn't committed")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/kevinwallace/crontab"
+)
+
+// sidecarFile is the path in a repo of the optional file giving entries' options, as an alternative to directives.
+const sidecarFile = ".crony/jobs.json"
+
+// readSidecar reads sidecarFile from fsys, which maps an entry's name, or its command, to its options,
+// e.g. {"nightly-report": {"timeout": "30m", "lock": "db"}}.
+// If the file doesn't exist, there are no options.
+func readSidecar(fsys *readFS) (map[string]map[string]string, error) {
+	data, err := fsys.ReadFile(sidecarFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sidecar map[string]map[string]string
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, fmt.Errorf("%s: %s", sidecarFile, err)
+	}
+	// Check in order, so that the same file always gives the same error.
+	var keys []string
+	for key := range sidecar {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var options []string
+		for option := range sidecar[key] {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			if !knownOptions[option] {
+				return nil, fmt.Errorf("%s: unknown option %q for %s", sidecarFile, option, key)
+			}
+		}
+	}
+	return sidecar, nil
+}
+
+// applySidecar gives each of entries the options sidecar has for it, by the name given in its directives, if any,
+// or else by its command, unless its directives give an option too, in which case theirs wins.
+// Options in sidecar for entries that aren't in entries are ignored, with a warning.
+func applySidecar(entries []crontab.Entry, sidecar map[string]map[string]string) {
+	used := make(map[string]bool)
+	for i, entry := range entries {
+		key := entry.Command
+		if name, ok := entry.Options["name"]; ok {
+			key = name
+		}
+		options, ok := sidecar[key]
+		if !ok {
+			continue
+		}
+		used[key] = true
+		merged := make(map[string]string)
+		for option, value := range options {
+			merged[option] = value
+		}
+		for option, value := range entry.Options {
+			merged[option] = value
+		}
+		entries[i].Options = merged
+	}
+	var unused []string
+	for key := range sidecar {
+		if !used[key] {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	for _, key := range unused {
+		glog.Warningf("%s has options for %s, but no entry has that name or command", sidecarFile, key)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSidecarOptions(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{
+		"crontab": "# crony: name=slow\n0 0 1 1 * sleep 30\n" +
+			"# crony: timeout=10s\n0 0 1 1 * sleep 0.5; date +%N > now.txt\n",
+		".crony/jobs.json": `{"slow": {"timeout": "300ms"}, "sleep 0.5; date +%N > now.txt": {"timeout": "100ms"}}`,
+	})
+	r := newTestRepo(t, execGit{}, origin)
+	queue := newCrontabQueue()
+	if err := pullCrontab(NewManager(0), r, queue); err != nil {
+		t.Fatal(err)
+	}
+	entries := <-queue.updates
+	if len(entries) != 2 {
+		t.Fatalf("read %d entries, want 2", len(entries))
+	}
+	var jobs []job
+	for _, entry := range entries {
+		j, err := newJob(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+
+	start := time.Now()
+	result := executeCommand(&EventBus{}, jobs[0], r, start, triggerSchedule, nil)
+	if result.Err == nil || !strings.Contains(result.Err.Error(), "timed out") {
+		t.Errorf("run with the sidecar's timeout returned %v, want it to time out", result.Err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %s, want it terminated after the sidecar's timeout", elapsed)
+	}
+	// The directive's timeout wins over the sidecar's.
+	if result := executeCommand(&EventBus{}, jobs[1], r, time.Now(), triggerSchedule, nil); result.Err != nil {
+		t.Errorf("run with the directive's timeout failed: %s", result.Err)
+	}
+
+	pushToOrigin(t, origin, map[string]string{".crony/jobs.json": `{"slow": {"timout": "300ms"}}`}, "misspell an option")
+	err := pullCrontab(NewManager(0), r, queue)
+	if pullErr, ok := err.(*PullError); !ok || pullErr.Kind != PullParse || !strings.Contains(err.Error(), `"timout"`) {
+		t.Errorf("pulling a sidecar with an unknown option returned %v, want a parse error naming it", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	stateFile = flag.String("state_file", "",
+		"File in which to record when each @since_success job last succeeded, so that its schedule carries on "+
+			"across restarts; if empty, such jobs run as soon as crony starts")
+)
+
+// successes records when each @since_success command last succeeded, by repo name, then command.
+type successes map[string]map[string]time.Time
+
+// readState reads the successes recorded in the file at path, which are empty if it doesn't exist.
+func readState(path string) (successes, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(successes), nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := make(successes)
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// writeState writes s to the file at path, replacing it in one go so that it's never left half-written.
+func writeState(path string, s successes) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
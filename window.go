@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kevinwallace/crontab"
+)
+
+// timeWindow is when a job may run, as set by its window and window_days options:
+// scheduled runs at other times are skipped, without changing its schedule.
+type timeWindow struct {
+	// Start and end of the window, in minutes since midnight, including start but not end.
+	// If end isn't after start, the window crosses midnight.
+	start, end int
+	// Days of the week on which the window starts, if it doesn't start every day.
+	days *crontab.Field
+	// As given, for logging.
+	spec string
+}
+
+// parseWindow parses a window option, e.g. "09:00-17:00" or "22:00-02:00",
+// along with a window_days option, a weekday field of a schedule such as "mon-fri", if it's set.
+func parseWindow(window, days string) (*timeWindow, error) {
+	startEnd := strings.SplitN(window, "-", 2)
+	if len(startEnd) != 2 {
+		return nil, fmt.Errorf("window must be a start and end time, e.g. 09:00-17:00: %s", window)
+	}
+	w := &timeWindow{spec: window}
+	for i, s := range startEnd {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return nil, fmt.Errorf("window must be a start and end time, e.g. 09:00-17:00: %s", window)
+		}
+		minutes := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = minutes
+		} else {
+			w.end = minutes
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window must end at a different time than it starts: %s", window)
+	}
+	if days != "" {
+		field, err := crontab.ParseField(days, crontab.Weekday)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window_days: %s", err)
+		}
+		w.days = &field
+		w.spec += " starting " + days
+	}
+	return w, nil
+}
+
+// contains determines whether t, in its own location, falls within the window.
+// A window that crosses midnight belongs to the day it starts on, so that, e.g.,
+// 22:00-02:00 starting fri contains 01:00 on Saturday, but not on Friday.
+func (w *timeWindow) contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return minutes >= w.start && minutes < w.end && w.startsOn(t)
+	}
+	return minutes >= w.start && w.startsOn(t) || minutes < w.end && w.startsOn(t.AddDate(0, 0, -1))
+}
+
+// startsOn determines whether the window starts on t's day.
+func (w *timeWindow) startsOn(t time.Time) bool {
+	return w.days == nil || w.days.Matches(int(t.Weekday()))
+}
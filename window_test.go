@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowSkipsRunsOutsideIt(t *testing.T) {
+	setUpGit(t)
+	origin := newOrigin(t, map[string]string{"crontab": "# nothing scheduled\n"})
+	executor := &recordingExecutor{}
+	m, r := newTestManager(t, execGit{}, executor, nil, origin)
+	j := testJob(t, "# crony: window=09:00-17:00\n*/30 * * * * ./poll")
+
+	var want []time.Time
+	day := time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+	for fire := j.Schedule.Next(day.Add(-time.Second)); fire.Before(day.AddDate(0, 0, 1)); fire = j.Schedule.Next(fire) {
+		if fire.Hour() >= 9 && fire.Hour() < 17 {
+			want = append(want, fire)
+		}
+		m.runJob(r, j, fire, triggerSchedule)
+	}
+	if got := len(executor.recorded()); got != len(want) {
+		t.Errorf("ran %d of the day's runs, want the %d from 09:00 to 16:30", got, len(want))
+	}
+	if len(want) != 16 {
+		t.Errorf("the schedule fires %d times from 09:00 to 17:00, want 16", len(want))
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// A Friday.
+	friday := func(hour, minute int) time.Time {
+		return time.Date(2026, time.October, 16, hour, minute, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		window, days string
+		at           time.Time
+		want         bool
+	}{
+		{"09:00-17:00", "", friday(9, 0), true},
+		{"09:00-17:00", "", friday(16, 59), true},
+		{"09:00-17:00", "", friday(17, 0), false},
+		{"09:00-17:00", "", friday(8, 59), false},
+		{"22:00-02:00", "", friday(23, 30), true},
+		{"22:00-02:00", "", friday(1, 30), true},
+		{"22:00-02:00", "", friday(2, 0), false},
+		{"22:00-02:00", "", friday(12, 0), false},
+		{"09:00-17:00", "mon-fri", friday(12, 0), true},
+		{"09:00-17:00", "mon-fri", friday(12, 0).AddDate(0, 0, 1), false},
+		// After midnight, the window belongs to the day it started on.
+		{"22:00-02:00", "fri", friday(1, 0), false},
+		{"22:00-02:00", "fri", friday(1, 0).AddDate(0, 0, 1), true},
+	} {
+		w, err := parseWindow(test.window, test.days)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(test.at); got != test.want {
+			t.Errorf("window %s on %q contains %s: %t, want %t", test.window, test.days, test.at.Format("Mon 15:04"), got, test.want)
+		}
+	}
+
+	for _, window := range []string{"9-5", "09:00", "09:00-09:00", "25:00-26:00"} {
+		if _, err := parseWindow(window, ""); err == nil {
+			t.Errorf("parsed window %s", window)
+		}
+	}
+	if _, err := parseWindow("09:00-17:00", "someday"); err == nil {
+		t.Error("parsed window_days someday")
+	}
+}